@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const configFile = ".rtest.toml"
+
+// config is the contents of a .rtest.toml file. The file is a small subset of
+// toml, one key = value per line where values are strings, booleans, numbers
+// or single line arrays of strings:
+//
+//	# the watch roots, relative to the config file
+//	roots = ["./svc-a", "./svc-b"]
+//	# extra patterns for .rtestignore
+//	ignore = ["node_modules", "assets/*"]
+//	# arguments for go test
+//	args = ["-race", "-count=1"]
+//	# commands bound to keys, like -rtest-bind
+//	bind = ["v=go vet ./...", "b=go build ./..."]
+//	# packages to test when other files change, like -rtest-map
+//	map = ["testdata/*.golden=./render"]
+//	# everything else is an rtest flag without the rtest- prefix
+//	debounce = "1s"
+//	clear = true
+//	notify = true
+type config struct {
+	path string
+
+	roots  []string
+	ignore []string
+	args   []string
+	binds  []string
+	maps   []string
+	flags  map[string]string
+}
+
+// configArgs are go test arguments from the config file
+var configArgs []string
+
+// findConfig searches dir and its parents for a config file, it returns an
+// empty string if there isn't one.
+func findConfig(dir string) string {
+	for {
+		path := filepath.Join(dir, configFile)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadConfig parses the config file at path.
+func loadConfig(path string) (*config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open config")
+	}
+	defer file.Close()
+
+	cfg := &config{path: path, flags: make(map[string]string)}
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		equals := strings.IndexByte(line, '=')
+		if equals < 0 {
+			return nil, errors.Errorf("%s:%d: expected key = value", path, lineNum)
+		}
+
+		key := strings.TrimSpace(line[:equals])
+		value, err := parseConfigValue(strings.TrimSpace(line[equals+1:]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, lineNum)
+		}
+
+		switch key {
+		case "roots":
+			cfg.roots = value
+		case "ignore":
+			cfg.ignore = value
+		case "args":
+			cfg.args = value
+		case "bind":
+			cfg.binds = value
+		case "map":
+			cfg.maps = value
+		default:
+			if len(value) != 1 {
+				return nil, errors.Errorf("%s:%d: %s takes a single value", path, lineNum, key)
+			}
+			if flag.Lookup("rtest-"+key) == nil {
+				return nil, errors.Errorf("%s:%d: unknown setting %s", path, lineNum, key)
+			}
+			cfg.flags[key] = value[0]
+		}
+	}
+
+	return cfg, errors.Wrap(scanner.Err(), "failed to read config")
+}
+
+// parseConfigValue parses a value, arrays are returned as multiple values.
+func parseConfigValue(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		v, err := parseConfigScalar(value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{v}, nil
+	}
+
+	if !strings.HasSuffix(value, "]") {
+		return nil, errors.New("arrays must be on a single line")
+	}
+
+	var values []string
+	for _, elem := range strings.Split(value[1:len(value)-1], ",") {
+		elem = strings.TrimSpace(elem)
+		if len(elem) == 0 {
+			continue
+		}
+
+		v, err := parseConfigScalar(elem)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+func parseConfigScalar(value string) (string, error) {
+	var s string
+	switch {
+	case strings.HasPrefix(value, `"`):
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			return "", errors.Errorf("bad string %s", value)
+		}
+		s, _ = strconv.Unquote(quoted)
+		value = value[len(quoted):]
+	case strings.HasPrefix(value, "'"):
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", errors.Errorf("bad string %s", value)
+		}
+		s = value[1 : end+1]
+		value = value[end+2:]
+	default:
+		// Numbers and booleans are handed to the flag package as they are
+		if i := strings.IndexByte(value, '#'); i >= 0 {
+			value = value[:i]
+		}
+		return strings.TrimSpace(value), nil
+	}
+
+	if rest := strings.TrimSpace(value); len(rest) != 0 && !strings.HasPrefix(rest, "#") {
+		return "", errors.Errorf("unexpected %s after string", rest)
+	}
+	return s, nil
+}
+
+// apply sets the flags from the config that weren't given on the command
+// line, and records the other settings.
+func (c *config) apply() error {
+	if err := c.applyFlags(); err != nil {
+		return err
+	}
+
+	configArgs = c.args
+
+	// Bindings and mappings from the command line replace the config's
+	// entirely
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	if !setOnCommandLine["rtest-bind"] {
+		for _, bind := range c.binds {
+			if err := flagBind.Set(bind); err != nil {
+				return errors.Wrapf(err, "%s: bad bind %s", c.path, bind)
+			}
+		}
+	}
+	if !setOnCommandLine["rtest-map"] {
+		for _, mapping := range c.maps {
+			if err := flagMap.Set(mapping); err != nil {
+				return errors.Wrapf(err, "%s: bad map %s", c.path, mapping)
+			}
+		}
+	}
+
+	for _, pattern := range c.ignore {
+		pattern = strings.TrimSuffix(filepath.FromSlash(pattern), string(filepath.Separator))
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "%s: bad ignore pattern %s", c.path, pattern)
+		}
+		ignorePatterns = append(ignorePatterns, pattern)
+	}
+
+	return nil
+}
+
+// applyFlags sets the flags from the config that haven't been set already,
+// either on the command line or by an earlier config.
+func (c *config) applyFlags() error {
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	for key, value := range c.flags {
+		name := "rtest-" + key
+		if setOnCommandLine[name] {
+			continue
+		}
+
+		if err := flag.Set(name, value); err != nil {
+			return errors.Wrapf(err, "%s: bad value for %s", c.path, key)
+		}
+	}
+
+	return nil
+}
+
+// debugConfig prints the settings rtest ended up with
+func debugConfig(cfg *config) {
+	if !*flagDebug {
+		return
+	}
+
+	if cfg != nil {
+		debugln("Config file:", cfg.path)
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		debugf("  -%s=%s\n", f.Name, f.Value)
+	})
+	debugln("  roots:", roots)
+	debugln("  ignore:", ignorePatterns)
+	debugln("  go test args:", fmt.Sprint(configArgs), os.Getenv(envArgs), testArgs)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// depGraph is the import graph of a module including test imports
+type depGraph struct {
+	// dirs maps import paths to the directory of the package
+	dirs map[string]string
+	// paths maps directories to the import path of the package in them
+	paths map[string]string
+	// importers maps import paths to the packages that import them
+	importers map[string][]string
+	// imports maps import paths to the packages in the module they import
+	imports map[string][]string
+	// testImporters maps import paths to the packages that only import
+	// them from their tests, and testOnly is set for the packages that
+	// nothing but tests import
+	testImporters map[string][]string
+	testOnly      map[string]bool
+}
+
+var (
+	// depGraphs caches the import graph of each module by its root, it's
+	// thrown away when go files are added or removed
+	depsMu    sync.Mutex
+	depGraphs = make(map[string]*depGraph)
+)
+
+// dependentDirs returns dir along with the directories of every package in
+// the module that imports the package in dir, directly or not.
+func dependentDirs(dir string) ([]string, error) {
+	graph, err := moduleGraph(dir)
+	if err != nil {
+		return nil, err
+	}
+	if graph == nil {
+		return []string{dir}, nil
+	}
+
+	path, ok := graph.paths[dir]
+	if !ok {
+		return []string{dir}, nil
+	}
+
+	seen := map[string]bool{path: true}
+	dirs := []string{dir}
+	work := []string{path}
+	for len(work) != 0 {
+		pkg := work[0]
+		work = work[1:]
+
+		for _, importer := range graph.importers[pkg] {
+			if seen[importer] {
+				continue
+			}
+			seen[importer] = true
+			work = append(work, importer)
+			dirs = append(dirs, graph.dirs[importer])
+		}
+	}
+
+	sort.Strings(dirs[1:])
+	return dirs, nil
+}
+
+// helperDirs returns dir along with the directories of the packages whose
+// tests import it, if the package in dir is a test helper that only tests
+// import.
+func helperDirs(dir string) ([]string, error) {
+	graph, err := moduleGraph(dir)
+	if err != nil {
+		return nil, err
+	}
+	if graph == nil {
+		return []string{dir}, nil
+	}
+
+	path, ok := graph.paths[dir]
+	if !ok || !graph.testOnly[path] {
+		return []string{dir}, nil
+	}
+
+	dirs := []string{dir}
+	for _, importer := range graph.testImporters[path] {
+		dirs = append(dirs, graph.dirs[importer])
+	}
+
+	sort.Strings(dirs[1:])
+	return dirs, nil
+}
+
+// importedDirs returns dir along with the directories of every package in
+// the module that the package in dir imports, directly or not.
+func importedDirs(dir string) ([]string, error) {
+	graph, err := moduleGraph(dir)
+	if err != nil {
+		return nil, err
+	}
+	if graph == nil {
+		return []string{dir}, nil
+	}
+
+	path, ok := graph.paths[dir]
+	if !ok {
+		return []string{dir}, nil
+	}
+
+	seen := map[string]bool{path: true}
+	dirs := []string{dir}
+	work := []string{path}
+	for len(work) != 0 {
+		pkg := work[0]
+		work = work[1:]
+
+		for _, imp := range graph.imports[pkg] {
+			if seen[imp] {
+				continue
+			}
+			seen[imp] = true
+			work = append(work, imp)
+			dirs = append(dirs, graph.dirs[imp])
+		}
+	}
+
+	return dirs, nil
+}
+
+// moduleGraph returns the import graph of the module dir is in, loading it
+// if it's not cached. It's nil when dir isn't in a module.
+func moduleGraph(dir string) (*depGraph, error) {
+	root := findModuleRoot(dir)
+	if len(root) == 0 {
+		return nil, nil
+	}
+
+	depsMu.Lock()
+	graph, ok := depGraphs[root]
+	depsMu.Unlock()
+
+	if ok {
+		return graph, nil
+	}
+
+	graph, err := loadDepGraph(root)
+	if err != nil {
+		return nil, err
+	}
+
+	depsMu.Lock()
+	depGraphs[root] = graph
+	depsMu.Unlock()
+
+	return graph, nil
+}
+
+// invalidateDeps throws away the cached import graphs
+func invalidateDeps() {
+	depsMu.Lock()
+	depGraphs = make(map[string]*depGraph)
+	depsMu.Unlock()
+}
+
+var (
+	// fileImports holds the imports of each go file written to so that a
+	// save that changes them throws away the import graph
+	fileImportsMu sync.Mutex
+	fileImports   = make(map[string]string)
+)
+
+// importsChanged checks if the imports of file are different from the last
+// time it was written to. The first write is taken as a change since the
+// imports before it aren't known. Files that can't be parsed, like ones
+// in the middle of being edited, are left for the next write.
+func importsChanged(file string) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.ImportsOnly)
+	if err != nil {
+		debugln("failed to read imports:", err)
+		return false
+	}
+
+	var imports []string
+	for _, imp := range f.Imports {
+		imports = append(imports, imp.Path.Value)
+	}
+	joined := strings.Join(imports, " ")
+
+	fileImportsMu.Lock()
+	defer fileImportsMu.Unlock()
+
+	prev, ok := fileImports[file]
+	fileImports[file] = joined
+	return !ok || prev != joined
+}
+
+// forgetImports forgets the imports of a file that went away
+func forgetImports(file string) {
+	fileImportsMu.Lock()
+	delete(fileImports, file)
+	fileImportsMu.Unlock()
+}
+
+// loadDepGraph uses go list to find the imports of every package in the
+// module rooted at root.
+func loadDepGraph(root string) (*depGraph, error) {
+	const format = `{{.ImportPath}}	{{.Dir}}	{{join .Imports " "}}	{{join .TestImports " "}} {{join .XTestImports " "}}`
+
+	debugln("loading import graph for:", root)
+
+	cmd := exec.Command(*flagGo, "list", "-e", "-f", format, "./...")
+	cmd.Dir = root
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list packages")
+	}
+
+	graph := &depGraph{
+		dirs:      make(map[string]string),
+		paths:     make(map[string]string),
+		importers: make(map[string][]string),
+		imports:   make(map[string][]string),
+
+		testImporters: make(map[string][]string),
+		testOnly:      make(map[string]bool),
+	}
+
+	imported := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(parts) != 4 {
+			continue
+		}
+
+		path, dir := parts[0], parts[1]
+		graph.dirs[path] = dir
+		graph.paths[dir] = path
+
+		seen := make(map[string]bool)
+		for _, imp := range strings.Fields(parts[2]) {
+			if seen[imp] || imp == path {
+				continue
+			}
+			seen[imp] = true
+			imported[imp] = true
+			graph.importers[imp] = append(graph.importers[imp], path)
+		}
+		for _, imp := range strings.Fields(parts[3]) {
+			if seen[imp] || imp == path {
+				continue
+			}
+			seen[imp] = true
+			graph.importers[imp] = append(graph.importers[imp], path)
+			graph.testImporters[imp] = append(graph.testImporters[imp], path)
+		}
+	}
+
+	for imp := range graph.testImporters {
+		graph.testOnly[imp] = !imported[imp]
+	}
+
+	// Only the imports of packages in the module are kept
+	for imp, importers := range graph.importers {
+		if _, ok := graph.dirs[imp]; !ok {
+			continue
+		}
+		for _, importer := range importers {
+			graph.imports[importer] = append(graph.imports[importer], imp)
+		}
+	}
+
+	return graph, errors.Wrap(scanner.Err(), "failed to read package list")
+}
+
+// findModuleRoot finds the directory containing the go.mod for dir, it
+// returns an empty string if there isn't one.
+func findModuleRoot(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestImportsChanged(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "code.go")
+	defer forgetImports(file)
+
+	steps := []struct {
+		contents string
+		changed  bool
+	}{
+		{"package a\n", true},
+		{"package a\n\nfunc A() {}\n", false},
+		{"package a\n\nimport \"fmt\"\n", true},
+		{"package a\n\nimport \"fmt\"\n\nfunc A() { fmt.Println() }\n", false},
+		{"package a\n\nimport (\n", false},
+		{"package a\n\nimport \"os\"\n", true},
+	}
+
+	for i, step := range steps {
+		writeTestFile(t, file, step.contents)
+		if changed := importsChanged(file); changed != step.changed {
+			t.Errorf("%d: want changed %t, got %t", i, step.changed, changed)
+		}
+	}
+}
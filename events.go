@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// runEvent describes a test run for the machine readable outputs:
+// -rtest-json, -rtest-http and -rtest-sock. The result is only filled in
+// once the run has finished.
+type runEvent struct {
+	Event    string    `json:"event,omitempty"`
+	Dir      string    `json:"dir"`
+	Packages []string  `json:"packages,omitempty"`
+	Start    time.Time `json:"start"`
+	*runResult
+}
+
+// runResult is how a finished run went.
+type runResult struct {
+	Finished time.Time `json:"finished"`
+	Elapsed  float64   `json:"elapsed"`
+	ExitCode int       `json:"exit_code"`
+	Passed   bool      `json:"passed"`
+	Failed   []string  `json:"failed,omitempty"`
+}
+
+func newRunResult(start, finished time.Time, passed bool, exitCode int) *runResult {
+	return &runResult{
+		Finished: finished,
+		Elapsed:  finished.Sub(start).Seconds(),
+		ExitCode: exitCode,
+		Passed:   passed,
+	}
+}
+
+// sockWriteTimeout is how long a -rtest-sock client gets to take an event
+// before it's dropped, a stuck editor mustn't hold up the test runs.
+const sockWriteTimeout = time.Second
+
+// sock streams run events to the clients connected to -rtest-sock
+var sock eventStream
+
+type eventStream struct {
+	mu       sync.Mutex
+	listener net.Listener
+	clients  map[net.Conn]struct{}
+}
+
+// serveSocket listens on the unix socket at path and adds every client that
+// connects to the stream, it only returns once the socket is closed.
+func (s *eventStream) serveSocket(path string) {
+	// A socket left behind by an rtest that didn't exit cleanly would make
+	// listening fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		errorln("failed to listen on socket:", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.listener = listener
+	s.clients = make(map[net.Conn]struct{})
+	s.mu.Unlock()
+
+	debugln("sending run events on:", path)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			debugln("socket closed:", err)
+			return
+		}
+
+		debugln("socket client connected")
+		s.mu.Lock()
+		s.clients[conn] = struct{}{}
+		s.mu.Unlock()
+	}
+}
+
+// send writes ev as a line of json to every client, clients that can't be
+// written to are dropped.
+func (s *eventStream) send(ev runEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.clients) == 0 {
+		return
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		debugln("failed to encode run event:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	for conn := range s.clients {
+		_ = conn.SetWriteDeadline(time.Now().Add(sockWriteTimeout))
+		if _, err := conn.Write(line); err != nil {
+			debugln("dropping socket client:", err)
+			conn.Close()
+			delete(s.clients, conn)
+		}
+	}
+}
+
+// close disconnects the clients and removes the socket.
+func (s *eventStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return
+	}
+
+	for conn := range s.clients {
+		conn.Close()
+	}
+	s.clients = nil
+	// Closing a unix listener removes its file
+	s.listener.Close()
+	s.listener = nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// isExcluded checks if the package in dir matches one of the -rtest-exclude
+// patterns. Patterns are relative to the working directory and end in /...
+// to match everything beneath a directory, eg. ./integration/...
+func isExcluded(dir string) bool {
+	for _, pattern := range strings.Split(*flagExclude, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) == 0 {
+			continue
+		}
+
+		recursive := strings.HasSuffix(pattern, "/...")
+		pattern = filepath.Join(workingDir, filepath.FromSlash(strings.TrimSuffix(pattern, "/...")))
+
+		if dir == pattern {
+			return true
+		}
+		if recursive && strings.HasPrefix(dir, strings.TrimSuffix(pattern, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withoutExcluded filters out the directories with excluded packages
+func withoutExcluded(dirs []string) []string {
+	var keep []string
+	for _, dir := range dirs {
+		if isExcluded(dir) {
+			debugln("excluded, skipping:", dir)
+			continue
+		}
+		keep = append(keep, dir)
+	}
+
+	return keep
+}
+
+// excludePackages removes excluded packages from the packages to be tested
+// in dir. go test can't leave packages out of a pattern like ./... so those
+// are expanded with go list first. No packages means the package in dir so
+// skip reports when everything is excluded.
+func excludePackages(dir string, pkgs []string) (keep []string, skip bool, err error) {
+	if len(*flagExclude) == 0 {
+		return pkgs, false, nil
+	}
+	if len(pkgs) == 0 {
+		return pkgs, isExcluded(dir), nil
+	}
+
+	pkgDirs, err := listPackages(dir, pkgs)
+	if err != nil {
+		return nil, false, err
+	}
+
+	keep, err = relativePackages(dir, withoutExcluded(pkgDirs))
+	return keep, len(keep) == 0, err
+}
+
+// listPackages uses go list to find the directories of the packages that
+// pkgs match from dir.
+func listPackages(dir string, pkgs []string) ([]string, error) {
+	args := append([]string{"list", "-e", "-f", "{{.Dir}}"}, pkgs...)
+	cmd := exec.Command(*flagGo, args...)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list packages")
+	}
+
+	var dirs []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if pkgDir := scanner.Text(); len(pkgDir) != 0 {
+			dirs = append(dirs, pkgDir)
+		}
+	}
+
+	return dirs, errors.Wrap(scanner.Err(), "failed to read package list")
+}
+
+// relativePackages turns package directories back into package arguments
+// for go test run from dir.
+func relativePackages(dir string, pkgDirs []string) ([]string, error) {
+	var pkgs []string
+	for _, pkgDir := range pkgDirs {
+		rel, err := filepath.Rel(dir, pkgDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to make %s relative", pkgDir)
+		}
+		if rel == "." {
+			pkgs = append(pkgs, ".")
+		} else {
+			pkgs = append(pkgs, "./"+filepath.ToSlash(rel))
+		}
+	}
+
+	return pkgs, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// flagMap holds the -rtest-map associations of files to the packages that
+// test them, for fixtures like golden files that aren't go files.
+var flagMap mapFlag
+
+// fileMapping maps files matching pattern, relative to the working
+// directory, to a package
+type fileMapping struct {
+	pattern string
+	pkg     string
+}
+
+type mapFlag []fileMapping
+
+func (m *mapFlag) String() string {
+	pairs := make([]string, len(*m))
+	for i, mapping := range *m {
+		pairs[i] = mapping.pattern + "=" + mapping.pkg
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (m *mapFlag) Set(s string) error {
+	equals := strings.LastIndexByte(s, '=')
+	if equals < 0 {
+		return errors.New("expected pattern=package")
+	}
+
+	pattern := strings.TrimSpace(filepath.FromSlash(s[:equals]))
+	pkg := strings.TrimSpace(s[equals+1:])
+	if len(pattern) == 0 || len(pkg) == 0 {
+		return errors.New("expected pattern=package")
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return errors.Wrapf(err, "bad pattern %s", pattern)
+	}
+
+	*m = append(*m, fileMapping{pattern: pattern, pkg: pkg})
+	return nil
+}
+
+// mappedPackages returns the packages that file is mapped to with -rtest-map.
+// Patterns are matched against the path relative to the working directory
+// and against the base name, like ignore patterns.
+func mappedPackages(file string) []string {
+	if len(flagMap) == 0 {
+		return nil
+	}
+
+	base := filepath.Base(file)
+	rel, err := filepath.Rel(workingDir, file)
+	if err != nil {
+		rel = file
+	}
+
+	var pkgs []string
+	for _, mapping := range flagMap {
+		if ok, _ := filepath.Match(mapping.pattern, rel); ok {
+			pkgs = append(pkgs, mapping.pkg)
+		} else if ok, _ := filepath.Match(mapping.pattern, base); ok {
+			pkgs = append(pkgs, mapping.pkg)
+		}
+	}
+	return pkgs
+}
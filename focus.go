@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+var (
+	// focus is the set of failing tests for the target in focusKey, with
+	// -rtest-focus-fails only they are run until they pass
+	focusMu  sync.Mutex
+	focusKey string
+	focus    []string
+)
+
+// focusRunArg creates a -run pattern for the failing tests of the target
+// if there are any. Asking about any other target clears the focus since
+// the user has moved on to something else.
+func focusRunArg(key string) string {
+	focusMu.Lock()
+	defer focusMu.Unlock()
+
+	if key != focusKey {
+		focusKey, focus = "", nil
+		return ""
+	}
+	if len(focus) == 0 {
+		return ""
+	}
+
+	return "^(" + strings.Join(focus, "|") + ")$"
+}
+
+// updateFocus records the result of a run. Failures become the focus, and
+// when a focused run passes the focus is cleared and true is returned to
+// signal that the whole package should be run again.
+func updateFocus(key string, focused, passed bool, failed []string) bool {
+	focusMu.Lock()
+	defer focusMu.Unlock()
+
+	if !passed && len(failed) != 0 {
+		debugln("focusing on failed tests:", failed)
+		focusKey, focus = key, failed
+		return false
+	}
+
+	focusKey, focus = "", nil
+	return focused && passed
+}
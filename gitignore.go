@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const gitignoreFile = ".gitignore"
+
+// gitignoreRule is a single pattern line from a .gitignore file
+type gitignoreRule struct {
+	// pattern is slash separated and split on the slashes
+	pattern []string
+	// negate is set for patterns starting with !
+	negate bool
+	// dirOnly is set for patterns ending in / which only match directories
+	dirOnly bool
+	// anchored patterns contain a slash and are matched against the path
+	// relative to the .gitignore, otherwise only the name is matched
+	anchored bool
+}
+
+var (
+	// gitignores holds the rules from each .gitignore that's been loaded
+	// keyed by the directory it was found in
+	gitignoreMu sync.RWMutex
+	gitignores  = make(map[string][]gitignoreRule)
+)
+
+// loadParentGitignores loads the .gitignore files from the top of the git
+// repository that contains root down to root's parent. The .gitignore files
+// at or beneath root are loaded as the tree is walked.
+func loadParentGitignores(root string) error {
+	var parents []string
+	for dir := filepath.Dir(root); ; dir = filepath.Dir(dir) {
+		parents = append(parents, dir)
+
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			break
+		}
+		if dir == filepath.Dir(dir) {
+			// Never found the repository so none of these apply
+			return nil
+		}
+	}
+
+	for i := len(parents) - 1; i >= 0; i-- {
+		if err := loadGitignore(parents[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadGitignore parses the .gitignore in dir if there is one.
+func loadGitignore(dir string) error {
+	file, err := os.Open(filepath.Join(dir, gitignoreFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to open %s", gitignoreFile)
+	}
+	defer file.Close()
+
+	var rules []gitignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule gitignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		rule.pattern = strings.Split(line, "/")
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "failed to read %s", filepath.Join(dir, gitignoreFile))
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	debugln("Loaded gitignore:", filepath.Join(dir, gitignoreFile), len(rules), "rules")
+
+	gitignoreMu.Lock()
+	gitignores[dir] = rules
+	gitignoreMu.Unlock()
+
+	return nil
+}
+
+// isGitignored checks if path is ignored by the loaded .gitignore files,
+// either by matching itself or by being inside an ignored directory.
+func isGitignored(p string) bool {
+	gitignoreMu.RLock()
+	defer gitignoreMu.RUnlock()
+
+	if len(gitignores) == 0 {
+		return false
+	}
+
+	var ancestors []string
+	for dir := filepath.Clean(p); ; dir = filepath.Dir(dir) {
+		ancestors = append(ancestors, dir)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	// Going from the top down means an ignored directory excludes
+	// everything inside it the way git does
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		if gitignoreMatch(ancestors[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gitignoreMatch evaluates all the rules that apply to p, the last rule to
+// match wins so that negations can re-include things. gitignoreMu must be
+// held.
+func gitignoreMatch(p string) bool {
+	var dirs []string
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if _, ok := gitignores[dir]; ok {
+			dirs = append(dirs, dir)
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	var ignored bool
+	var isDir *bool
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], p)
+		if err != nil {
+			continue
+		}
+		name := strings.Split(filepath.ToSlash(rel), "/")
+
+		for _, rule := range gitignores[dirs[i]] {
+			if !rule.match(name) {
+				continue
+			}
+			if rule.dirOnly {
+				if isDir == nil {
+					fi, err := os.Stat(p)
+					b := err == nil && fi.IsDir()
+					isDir = &b
+				}
+				if !*isDir {
+					continue
+				}
+			}
+
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
+
+// match checks the rule against a path relative to the .gitignore it came
+// from, split on slashes.
+func (g gitignoreRule) match(name []string) bool {
+	if !g.anchored {
+		return matchSegments(g.pattern, name[len(name)-1:])
+	}
+
+	return matchSegments(g.pattern, name)
+}
+
+// matchSegments matches glob segments against path segments where a **
+// segment matches zero or more path segments.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"sync"
+)
+
+// groupMu keeps the blocks of output from -rtest-jobs runs from mixing
+var groupMu sync.Mutex
+
+// groupedOutput holds on to a run's output until it's finished so runs
+// happening at the same time each show up as one block.
+type groupedOutput struct {
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+// flush writes out the run's output, groupMu must be held.
+func (g *groupedOutput) flush() {
+	_, _ = os.Stdout.Write(g.stdout.Bytes())
+	_, _ = os.Stderr.Write(g.stderr.Bytes())
+	g.stdout.Reset()
+	g.stderr.Reset()
+}
+
+// groupOutput decides if run output is held back until the run finishes,
+// programs started with -rtest-run need their output as it happens.
+func groupOutput() bool {
+	return *flagJobs > 1 && *flagRun == ""
+}
+
+// maxRuns is how many runs can happen at the same time
+func maxRuns() int {
+	if *flagJobs > *flagParallelism {
+		return *flagJobs
+	}
+	return *flagParallelism
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"go/scanner"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fileHashes holds the contents hash of each file as it was when it last
+// changed for -rtest-hash, saves that don't change anything are skipped.
+// codeHashes are the same for -rtest-skip-trivial but only hash the code.
+var (
+	hashesMu   sync.Mutex
+	fileHashes = make(map[string][sha256.Size]byte)
+	codeHashes = make(map[string][sha256.Size]byte)
+)
+
+// sameContents checks if file has the same contents it had the last time
+// it was seen and remembers them for next time. Files that can't be read
+// are never the same.
+func sameContents(file string) bool {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(b)
+
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+
+	last, ok := fileHashes[file]
+	fileHashes[file] = sum
+	return ok && last == sum
+}
+
+// sameCode checks if the go file has the same code it had the last time it
+// was seen, ignoring comments and formatting, and remembers it for next
+// time. Files that can't be read or scanned are never the same. Saves that
+// truncate the file before writing it are two changes, the coalesce and
+// debounce windows make them one run.
+func sameCode(file string) bool {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+
+	sum, ok := codeHash(file, src)
+	if !ok {
+		return false
+	}
+
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+
+	last, ok := codeHashes[file]
+	codeHashes[file] = sum
+	return ok && last == sum
+}
+
+// codeHash hashes the tokens of a go file, which leaves out whitespace and
+// comments. Comments that are directives (//go:build, //go:embed, ...) are
+// code though, and with cgo so is the comment above import "C".
+func codeHash(file string, src []byte) (sum [sha256.Size]byte, ok bool) {
+	errs := 0
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	s.Init(fset.AddFile(file, -1, len(src)), src, func(token.Position, string) { errs++ }, scanner.ScanComments)
+
+	h := sha256.New()
+	var comments []string
+	cgo := false
+	prev := token.ILLEGAL
+	semicolon := false
+	for {
+		_, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+
+		switch {
+		case tok == token.COMMENT:
+			if strings.HasPrefix(lit, "//go:") || strings.HasPrefix(lit, "// +build") || strings.HasPrefix(lit, "//line ") {
+				h.Write([]byte(lit + "\n"))
+			}
+			comments = append(comments, lit)
+			continue
+		case tok == token.SEMICOLON:
+			// Semicolons are inserted at line ends but can be left out
+			// before a closing ) or }, so whether there's one depends on
+			// the formatting until the next token shows up
+			semicolon = true
+			continue
+		case tok == token.STRING && prev == token.IMPORT && lit == `"C"`:
+			cgo = true
+		}
+
+		if semicolon && tok != token.RPAREN && tok != token.RBRACE {
+			h.Write([]byte(";\n"))
+		}
+		semicolon = false
+
+		h.Write([]byte(tok.String() + " " + lit + "\n"))
+		prev = tok
+	}
+
+	if errs != 0 {
+		debugln("failed to scan, running tests:", file)
+		return sum, false
+	}
+	if cgo {
+		h.Write([]byte(strings.Join(comments, "\n")))
+	}
+
+	copy(sum[:], h.Sum(nil))
+	return sum, true
+}
+
+// forgetContents forgets the hashes of path and everything beneath it.
+func forgetContents(path string) {
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for _, hashes := range []map[string][sha256.Size]byte{fileHashes, codeHashes} {
+		for file := range hashes {
+			if file == path || strings.HasPrefix(file, prefix) {
+				delete(hashes, file)
+			}
+		}
+	}
+}
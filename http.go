@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// jsonStatus is served by -rtest-http so editors and status bars can poll
+// rtest instead of parsing its output.
+type jsonStatus struct {
+	Running  bool `json:"running"`
+	Runs     int  `json:"runs"`
+	Failures int  `json:"failures"`
+	// Last is the most recent finished run
+	Last *runEvent `json:"last,omitempty"`
+}
+
+// serveStatus serves the status on addr, it only returns if the server
+// can't be started.
+func serveStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleStatus)
+
+	debugln("serving status on:", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		errorln("failed to serve status:", err)
+	}
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	s := lastSummary()
+
+	status := jsonStatus{
+		Running:  isRunning(),
+		Runs:     s.runs,
+		Failures: s.failures,
+	}
+	if s.runs != 0 {
+		status.Last = &runEvent{
+			Dir:       s.dir,
+			Packages:  s.pkgs,
+			Start:     s.start,
+			runResult: newRunResult(s.start, s.finished, s.passed, s.code),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		debugln("failed to write status:", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idle runs -rtest-idle-cmd once file changes have stopped for a while
+var idle idleTimer
+
+type idleTimer struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	run     *testRun
+	stopped bool
+}
+
+// activity restarts the wait for things to go quiet. An idle command that's
+// still running is stopped since what it's checking has changed.
+func (i *idleTimer) activity() {
+	if *flagIdleCmd == "" {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.stopped {
+		return
+	}
+	if i.run != nil {
+		i.run.kill()
+		i.run = nil
+	}
+
+	if i.timer == nil {
+		i.timer = time.AfterFunc(*flagIdleAfter, i.fire)
+	} else {
+		i.timer.Reset(*flagIdleAfter)
+	}
+}
+
+// fire runs the idle command in the working directory. It's run like a step
+// of a test run so that it can be killed the same way.
+func (i *idleTimer) fire() {
+	if atomic.LoadInt32(&paused) == 1 {
+		return
+	}
+
+	run := &testRun{dir: workingDir, killed: make(chan struct{}), done: make(chan struct{})}
+	i.mu.Lock()
+	if i.stopped {
+		i.mu.Unlock()
+		return
+	}
+	i.run = run
+	i.mu.Unlock()
+
+	infoln("Idle for", *flagIdleAfter, "running:", *flagIdleCmd)
+	cmd := shellCommand(*flagIdleCmd)
+	cmd.Dir = workingDir
+	cmd.Stdout = humanOutput()
+	cmd.Stderr = os.Stderr
+	err := run.exec(cmd)
+
+	i.mu.Lock()
+	if i.run == run {
+		i.run = nil
+	}
+	i.mu.Unlock()
+
+	switch {
+	case run.wasKilled():
+	case err != nil:
+		errorln("idle command failed:", err)
+	default:
+		infoln("Idle command passed")
+	}
+}
+
+// stop stops the idle command for good, killing it if it's running
+func (i *idleTimer) stop() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.stopped = true
+	if i.timer != nil {
+		i.timer.Stop()
+	}
+	if i.run != nil {
+		i.run.kill()
+	}
+}
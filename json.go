@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// jsonRun is written to stdout once per run in -rtest-json mode, each one is
+// a single line so that consumers can read them with a line scanner.
+type jsonRun struct {
+	runEvent
+	Events []json.RawMessage `json:"events"`
+}
+
+// jsonOutput is what non-json lines from go test's stdout are wrapped in so
+// they have the same shape as test2json's output events.
+type jsonOutput struct {
+	Action string
+	Output string
+}
+
+// writeJSONRun writes the json document for a finished run to w.
+func writeJSONRun(w io.Writer, t *testRun, start time.Time, elapsed time.Duration, exitCode int) error {
+	run := jsonRun{
+		runEvent: runEvent{
+			Dir:       t.dir,
+			Packages:  t.pkgs,
+			Start:     start,
+			runResult: newRunResult(start, start.Add(elapsed), exitCode == 0, exitCode),
+		},
+		Events: []json.RawMessage{},
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(t.jsonOut.Bytes()))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		if json.Valid(line) {
+			run.Events = append(run.Events, json.RawMessage(append([]byte(nil), line...)))
+			continue
+		}
+
+		event, err := json.Marshal(jsonOutput{Action: "output", Output: string(line) + "\n"})
+		if err != nil {
+			return err
+		}
+		run.Events = append(run.Events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(run)
+}
+
+// humanOutput is where output meant for people goes, in json mode stdout is
+// reserved for the json documents.
+func humanOutput() io.Writer {
+	if *flagJSON {
+		return os.Stderr
+	}
+
+	return os.Stdout
+}
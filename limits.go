@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// inotifyWatchesFile is where linux keeps the limit on inotify watches
+const inotifyWatchesFile = "/proc/sys/fs/inotify/max_user_watches"
+
+// watchWarning makes sure the warning about the watch limit only happens once
+var watchWarning sync.Once
+
+// checkWatchCount warns when the number of watches gets close to the limit
+// set by -rtest-max-watches or by the kernel.
+func checkWatchCount(count int) {
+	limit := *flagMaxWatches
+	if limit <= 0 {
+		limit = kernelWatchLimit()
+	}
+	if limit <= 0 || count < limit*9/10 {
+		return
+	}
+
+	watchWarning.Do(func() {
+		warnf("%d directories are being watched, close to the limit of %d\n", count, limit)
+		warnln(watchLimitHelp)
+	})
+}
+
+// watchLimitError turns running out of inotify watches into an error that
+// explains what to do about it.
+func watchLimitError(err error, path string, count int) error {
+	if errors.Cause(err) != syscall.ENOSPC {
+		return errors.Wrapf(err, "failed to add watch to %s", path)
+	}
+
+	return errors.Errorf("ran out of inotify watches adding %s after watching %d directories\n%s", path, count, watchLimitHelp)
+}
+
+const watchLimitHelp = `The inotify watch limit can be raised with:
+    sudo sysctl fs.inotify.max_user_watches=524288
+and made permanent by adding fs.inotify.max_user_watches=524288 to
+/etc/sysctl.conf, or watch fewer directories using .rtestignore.`
+
+// kernelWatchLimit reads the inotify watch limit, it returns 0 when it can't
+// be found which is always the case outside of linux.
+func kernelWatchLimit() int {
+	b, err := ioutil.ReadFile(inotifyWatchesFile)
+	if err != nil {
+		return 0
+	}
+
+	limit, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+
+	return limit
+}
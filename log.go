@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// logLevel decides which of rtest's own messages are shown, test output is
+// always shown.
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var logLevels = map[string]logLevel{
+	"error": levelError,
+	"warn":  levelWarn,
+	"info":  levelInfo,
+	"debug": levelDebug,
+}
+
+// currentLevel is set from -rtest-log-level, -rtest-debug is the same as
+// the debug level
+var currentLevel = levelInfo
+
+// setLogLevel sets the level from its name, debug turns on -rtest-debug.
+func setLogLevel(name string) error {
+	level, ok := logLevels[name]
+	if !ok {
+		return errors.New("-rtest-log-level must be one of: error, warn, info, debug")
+	}
+
+	if *flagDebug {
+		level = levelDebug
+	}
+	*flagDebug = level == levelDebug
+	currentLevel = level
+	return nil
+}
+
+func errorln(args ...interface{}) {
+	if currentLevel >= levelError {
+		fmt.Fprintln(os.Stderr, append([]interface{}{"rtest:"}, args...)...)
+	}
+}
+
+func warnln(args ...interface{}) {
+	if currentLevel >= levelWarn {
+		fmt.Fprintln(os.Stderr, append([]interface{}{"rtest: warning:"}, args...)...)
+	}
+}
+
+func warnf(format string, args ...interface{}) {
+	if currentLevel >= levelWarn {
+		fmt.Fprintf(os.Stderr, "rtest: warning: "+format, args...)
+	}
+}
+
+func infoln(args ...interface{}) {
+	if currentLevel >= levelInfo {
+		fmt.Fprintln(os.Stderr, args...)
+	}
+}
+
+func debugln(args ...interface{}) {
+	if *flagDebug {
+		fmt.Fprintln(debugOut, args...)
+	}
+}
+
+func debugf(format string, args ...interface{}) {
+	if *flagDebug {
+		fmt.Fprintf(debugOut, format, args...)
+	}
+}
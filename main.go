@@ -4,19 +4,204 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
 )
 
+const ignoreFile = ".rtestignore"
+
+// throttleSweepSize is how big the throttle map can get before it's swept
+// of old entries
+const throttleSweepSize = 1024
+
 var (
-	flagDebug = flag.Bool("rtest-debug", false, "Turn on inotify debug information")
+	flagDebug           = flag.Bool("rtest-debug", false, "Turn on inotify debug information")
+	flagLogLevel        = flag.String("rtest-log-level", "info", "Which of rtest's own messages to show: error, warn, info or debug")
+	flagLog             = flag.String("rtest-log", "", "Append a line about every finished run to this file")
+	flagDebugFile       = flag.String("rtest-debug-file", "", "Append debug information to this file instead of stderr, implies -rtest-debug")
+	flagDebounce        = flag.Duration("rtest-debounce", 800*time.Millisecond, "Ignore repeats of the same event within this window (0 disables)")
+	flagNoThrottle      = flag.Bool("rtest-no-throttle", false, "Give every file event a run of its own that isn't skipped, merged or cut short, for scripted setups")
+	flagClear           = flag.Bool("rtest-clear", false, "Clear the terminal before each test run (ignored with -rtest-debug)")
+	flagVerbose         = flag.Bool("rtest-verbose", false, "Always run go test with -v")
+	flagNotify          = flag.Bool("rtest-notify", false, "Send a desktop notification when a test run finishes")
+	flagBell            = flag.Bool("rtest-bell", false, "Ring the terminal bell when a test run fails")
+	flagNotifyOnChange  = flag.Bool("rtest-notify-on-change", false, "Only notify or ring the bell when a target goes from passing to failing or back")
+	flagGitignore       = flag.Bool("rtest-gitignore", false, "Don't watch or run tests for paths ignored by .gitignore files")
+	flagPre             = flag.String("rtest-pre", "", "Shell command to run before the tests, the tests are skipped if it fails")
+	flagRetry           = flag.Int("rtest-retry", 0, "Run failing tests again up to this many times before reporting them failed, for flaky tests")
+	flagNoEnter         = flag.Bool("rtest-no-enter", false, "Don't read commands from stdin, only file changes run tests")
+	flagIdleCmd         = flag.String("rtest-idle-cmd", "", "Shell command to run once there have been no file changes for -rtest-idle-after, eg. a slower full check")
+	flagIdleAfter       = flag.Duration("rtest-idle-after", 30*time.Second, "How long files have to go unchanged before -rtest-idle-cmd runs")
+	flagPost            = flag.String("rtest-post", "", "Shell command to run after each test run whether it passed or not, eg. to tear things down")
+	flagGenerate        = flag.Bool("rtest-generate", false, "Run go generate before the tests, the tests are skipped if it fails")
+	flagGenerateExt     = flag.String("rtest-generate-ext", ".proto,.tmpl", "Comma separated extensions of go generate inputs that trigger a run with -rtest-generate")
+	flagExt             = flag.String("rtest-ext", ".go", "Comma separated extensions of files that trigger a run when changed")
+	flagNoHeader        = flag.Bool("rtest-no-header", false, "Don't print a header line before each test run")
+	flagShutdownTimeout = flag.Duration("rtest-shutdown-timeout", 0, "How long to wait for a running test to finish when exiting before killing it")
+	flagJSON            = flag.Bool("rtest-json", false, "Write a json document to stdout for each run containing the go test -json output")
+	flagCmd             = flag.String("rtest-cmd", "", "Command to run instead of go test, {dir} and {args} are replaced with the package directory and go test arguments")
+	flagDeps            = flag.Bool("rtest-deps", false, "Also test the packages that import the changed package")
+	flagWithHelpers     = flag.Bool("rtest-with-helpers", false, "When a package only tests import changes, test the packages whose tests import it")
+	flagMaxWatches      = flag.Int("rtest-max-watches", 0, "Warn when the number of watched directories nears this (0 uses the inotify limit)")
+	flagFocusFails      = flag.Bool("rtest-focus-fails", false, "After a failure only run the failing tests until they pass, then run everything again")
+	flagFuzz            = flag.String("rtest-fuzz", "", "Fuzz the changed package with go test -fuzz using this regexp")
+	flagFuzzTime        = flag.Duration("rtest-fuzztime", 10*time.Second, "How long each -rtest-fuzz run fuzzes for")
+	flagIncludeNoTest   = flag.Bool("rtest-include-notest", false, "Run go test for packages without _test.go files to check they build")
+	flagEchoCmd         = flag.Bool("rtest-echo-cmd", false, "Print each test command, with the directory it runs in, in a form that can be pasted into a shell")
+	flagTarget          = flag.String("rtest-target", "", "Package to test on every change instead of the package that changed, eg. ./pkg/b")
+	flagWarmup          = flag.Bool("rtest-warmup", false, "Run go build on everything once at startup so the build cache is filled before the first change")
+	flagBuildGate       = flag.Bool("rtest-build-gate", false, "Compile the packages with go build first and only run the tests if that works")
+	flagBuild           = flag.Bool("rtest-build", false, "Only compile the changed packages with go build instead of running tests")
+	flagColor           = flag.String("rtest-color", "auto", "Color status lines: auto (when stderr is a terminal), always, never")
+	flagNoDigest        = flag.Bool("rtest-no-digest", false, "Don't list the failed tests at the end of a run")
+	flagExecPrefix      = flag.String("rtest-exec-prefix", "", "Command to run go test through, eg. to run it in a container, see the readme")
+	flagMatch           = flag.String("rtest-match", "", "Only run tests matching this pattern (go test -run), change it by typing /pattern while running")
+	flagHTTP            = flag.String("rtest-http", "", "Serve the status of the last run as json on this address, eg. localhost:7070")
+	flagSock            = flag.String("rtest-sock", "", "Stream run events as lines of json to clients of a unix socket at this path")
+	flagOncePerPackage  = flag.Bool("rtest-once-per-package", false, "Skip packages whose go files and imports haven't changed since their tests last passed")
+	flagMinInterval     = flag.Duration("rtest-min-interval", 0, "Minimum time between the start of two test runs")
+	flagDryRun          = flag.Bool("rtest-dry-run", false, "Print the commands that would be run instead of running them")
+	flagRunOnStart      = flag.Bool("rtest-run-on-start", false, "Run the tests beneath the watched directories once at startup")
+	flagSkipDirs        = flag.String("rtest-skip-dirs", "vendor,.git,node_modules", "Names of directories that are never watched, comma separated")
+	flagWatchTestdata   = flag.Bool("rtest-watch-testdata", false, "Watch testdata directories so changes to fixtures run the tests")
+	flagRun             = flag.String("rtest-run", "", "Restart go run for this package on changes instead of running tests, arguments after -- are passed to the program")
+	flagAll             = flag.Bool("rtest-all", false, "Run every test in the module on any change instead of only the changed package")
+	flagGo              = flag.String("rtest-go", "go", "The go command to use, eg. to pick one of several toolchains")
+	flagGOOS            = flag.String("rtest-goos", "", "GOOS to build and test for, eg. windows")
+	flagGOARCH          = flag.String("rtest-goarch", "", "GOARCH to build and test for, eg. 386")
+	flagTags            = flag.String("rtest-tags", "", "Build tags to test with, passed to go test as -tags, eg. integration")
+	flagNoCache         = flag.Bool("rtest-nocache", false, "Pass -count=1 so test results are never cached")
+	flagExclude         = flag.String("rtest-exclude", "", "Packages to never test, comma separated and relative to the working directory, eg. ./integration/...")
+	flagRewatchOnBurst  = flag.Bool("rtest-rewatch-on-burst", false, "Rebuild the watches after a burst of creates and removes, like a git checkout")
+	flagHash            = flag.Bool("rtest-hash", false, "Skip saves that don't change a file's contents")
+	flagSkipTrivial     = flag.Bool("rtest-skip-trivial", false, "Skip saves of .go files that only change comments or formatting")
+	flagSmart           = flag.Bool("rtest-smart", false, "Run every test in the module when a _test.go file changes and only the package otherwise")
+	flagPrefix          = flag.String("rtest-prefix", "auto", "Prefix output lines with the package being tested: auto, always, never. auto prefixes lines while more than one run is going")
+	flagParallelism     = flag.Int("rtest-parallelism", 1, "How many test runs for different packages can happen at once")
+	flagJobs            = flag.Int("rtest-jobs", 1, "Test changed packages in separate runs, this many at once, showing each one's output as a block when it finishes")
+	flagFollowSymlinks  = flag.Bool("rtest-follow-symlinks", false, "Watch the directories symlinks point to")
+	flagGoFlags         = flag.String("rtest-goflags", "", "Extra flags passed to go test after RTEST_ARGS and before the command line arguments")
+	flagOnce            = flag.Bool("rtest-once", false, "Run the tests once without watching and exit with their exit code")
+	flagTimeout         = flag.Duration("rtest-timeout", 0, "Kill a test run that takes longer than this, 0 means no limit")
+	flagMod             = flag.String("rtest-mod", "", "Run go mod tidy or go mod download before testing the module when go.mod or go.sum change")
+	flagCoalesce        = flag.Duration("rtest-coalesce", 200*time.Millisecond, "Wait for changes to stop for this long and test all changed packages at once (0 disables)")
+)
+
+// flagBench is set with -rtest-bench, on its own it runs every benchmark and
+// it can be given a regexp: -rtest-bench=BenchmarkFoo
+var flagBench benchFlag
+
+type benchFlag string
+
+func (b *benchFlag) String() string   { return string(*b) }
+func (b *benchFlag) IsBoolFlag() bool { return true }
+func (b *benchFlag) Set(s string) error {
+	switch s {
+	case "true":
+		*b = "."
+	case "false":
+		*b = ""
+	default:
+		*b = benchFlag(s)
+	}
+	return nil
+}
+
+// flagBind holds the commands bound to keys with -rtest-bind, each one is
+// given as key=command and typing the key runs the command.
+var flagBind = make(bindFlag)
+
+type bindFlag map[string]string
+
+// builtinKeys are the stdin commands that can't be bound
+var builtinKeys = []string{"!", "?", "w", "l", "p", "r", "q", "cd"}
+
+func (b bindFlag) String() string {
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + b[key]
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (b bindFlag) Set(s string) error {
+	equals := strings.IndexByte(s, '=')
+	if equals < 0 {
+		return errors.New("expected key=command")
+	}
+
+	key, command := strings.TrimSpace(s[:equals]), strings.TrimSpace(s[equals+1:])
+	if len(key) == 0 || strings.ContainsAny(key, " \t") || strings.HasPrefix(key, "/") {
+		return errors.Errorf("bad key %q", key)
+	}
+	for _, builtin := range builtinKeys {
+		if key == builtin {
+			return errors.Errorf("%s is already a command", key)
+		}
+	}
+	if len(command) == 0 {
+		return errors.Errorf("no command for %s", key)
+	}
+
+	b[key] = command
+	return nil
+}
+
+func init() {
+	flag.Var(&flagBench, "rtest-bench", "Run benchmarks (matching the optional regexp) instead of tests, give -run to run tests too")
+	flag.Var(&flagMap, "rtest-map", "Test a package when files matching a pattern change as pattern=package, eg. 'testdata/*.golden=./render', can be given more than once")
+	flag.Var(flagBind, "rtest-bind", "Bind a shell command to a key typed into rtest as key=command, eg. v='go vet ./...', can be given more than once")
+}
+
+var (
+	ignoreRoot     string
+	ignorePatterns []string
+
+	// watched is the set of directories that have a watch on them
+	watchedMu sync.Mutex
+	watched   = make(map[string]struct{})
+	// walkedDirs counts the directories addWatches has looked at, watched
+	// or not
+	walkedDirs int64
+
+	// paused is set to 1 when file changes should be ignored
+	paused int32
+	// scope is the directory changes have to be in to run tests, set with
+	// the cd command, empty means anywhere
+	scopeMu sync.Mutex
+	scope   string
+	// quit is closed when the user asks to quit
+	quit = make(chan struct{})
+
+	// workingDir is where rtest was started
+	workingDir string
+
+	// roots are the directories being watched, testArgs are passed through
+	// to go test
+	roots    []string
+	testArgs []string
+
+	// debugOut is where debug information is written
+	debugOut io.Writer = os.Stderr
 )
 
 func main() {
@@ -26,189 +211,1070 @@ func main() {
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "failed to get working dir", err)
 	}
+	workingDir = wd
+
+	configPath := findConfig(wd)
+	stateDir := wd
+	if len(configPath) != 0 {
+		stateDir = filepath.Dir(configPath)
+	}
+	// Settings changed while rtest was last running beat the config file
+	if err := loadState(stateDir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var cfg *config
+	if len(configPath) != 0 {
+		if cfg, err = loadConfig(configPath); err == nil {
+			err = cfg.apply()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if err := setLogLevel(*flagLogLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *flagDebugFile != "" {
+		f, err := os.OpenFile(*flagDebugFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to open debug file", err)
+			os.Exit(1)
+		}
+		*flagDebug = true
+		debugOut = f
+	}
+	if *flagLog != "" {
+		f, err := os.OpenFile(*flagLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to open run log", err)
+			os.Exit(1)
+		}
+		runLog = f
+	}
+
+	var dirs []string
+	dirs, testArgs = splitArgs(os.Args, flag.Args())
+	rootsFrom := wd
+	if len(dirs) == 0 && cfg != nil && len(cfg.roots) != 0 {
+		dirs, rootsFrom = cfg.roots, filepath.Dir(cfg.path)
+	}
+	if roots, err = resolveRoots(rootsFrom, dirs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := loadIgnoreFile(wd); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	debugConfig(cfg)
+
+	// Without go every run would fail, a custom command or one that runs
+	// somewhere else might not need it here
+	if *flagCmd == "" && *flagExecPrefix == "" {
+		if _, err := exec.LookPath(*flagGo); err != nil {
+			fmt.Fprintf(os.Stderr, "can't find %s, install go or point -rtest-go at it: %v\n", *flagGo, err)
+			os.Exit(1)
+		}
+	}
 
-	watcher, err := initWatches(wd)
+	if *flagParallelism < 1 {
+		fmt.Fprintln(os.Stderr, "-rtest-parallelism must be at least 1")
+		os.Exit(1)
+	}
+	if *flagJobs < 1 {
+		fmt.Fprintln(os.Stderr, "-rtest-jobs must be at least 1")
+		os.Exit(1)
+	}
+
+	switch *flagMod {
+	case "", "tidy", "download":
+	default:
+		fmt.Fprintln(os.Stderr, "-rtest-mod must be one of: tidy, download")
+		os.Exit(1)
+	}
+
+	switch *flagPrefix {
+	case "auto", "always", "never":
+	default:
+		fmt.Fprintln(os.Stderr, "-rtest-prefix must be one of: auto, always, never")
+		os.Exit(1)
+	}
+
+	switch *flagColor {
+	case "auto", "always", "never":
+	default:
+		fmt.Fprintln(os.Stderr, "-rtest-color must be one of: auto, always, never")
+		os.Exit(1)
+	}
+
+	if *flagCmd != "" && len(strings.Fields(*flagCmd)) == 0 {
+		fmt.Fprintln(os.Stderr, "-rtest-cmd can't be blank")
+		os.Exit(1)
+	}
+
+	// A prefix of only unset variables leaves nothing to run the tests with
+	if *flagExecPrefix != "" && len(strings.Fields(os.ExpandEnv(*flagExecPrefix))) == 0 {
+		fmt.Fprintf(os.Stderr, "-rtest-exec-prefix %q is empty once environment variables are expanded\n", *flagExecPrefix)
+		os.Exit(1)
+	}
+
+	if *flagOnce {
+		os.Exit(runOnce(wd))
+	}
+
+	watcher, err := initWatches(roots)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
+	if *flagWarmup {
+		warmup(wd)
+	}
+
+	go runWorker()
 	go handleEvents(watcher)
-	go handleEnter(wd)
+	// Under a supervisor or with a pipe there's nobody typing commands
+	if !*flagNoEnter && isTerminal(os.Stdin) {
+		go handleEnter(wd, watcher)
+	} else {
+		debugln("not reading commands from stdin")
+	}
+	if *flagHTTP != "" {
+		go serveStatus(*flagHTTP)
+	}
+	if *flagSock != "" {
+		go sock.serveSocket(*flagSock)
+	}
+
+	// A program being run is always started, tests only when asked for a
+	// baseline before anything changes
+	if *flagRunOnStart || *flagRun != "" {
+		if err := runTestsForDir(wd); err != nil {
+			errorln(err)
+		}
+	}
 
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, os.Interrupt, os.Kill)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 
-	// when we get a signal, close the watcher and exit
-	<-sigs
+	// when we get a signal or are told to quit, close the watcher and exit
+	select {
+	case <-sigs:
+	case <-quit:
+	}
 
-	fmt.Fprintln(os.Stderr, "Exiting")
+	infoln("Exiting")
+	queue.stop()
+	idle.stop()
+	sock.close()
+	shutdownRunning(*flagShutdownTimeout)
 	if err = watcher.Close(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+
+	s := lastSummary()
+	printSummary(s)
+	os.Exit(s.exitCode())
+}
+
+// splitArgs separates the positional arguments into directories to watch and
+// arguments for go test. Directories come before a -- and go test arguments
+// after it:
+//
+//	rtest [rtest-flags] [dirs...] -- [go test flags]
+//
+// The flag package swallows the -- when it directly follows the flags, in
+// which case everything left belongs to go test.
+func splitArgs(osArgs, args []string) (dirs []string, goTestArgs []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+
+	if sep := len(osArgs) - len(args) - 1; sep > 0 && osArgs[sep] == "--" {
+		return nil, args
+	}
+
+	return args, nil
 }
 
-func initWatches(workingDir string) (*fsnotify.Watcher, error) {
+// resolveRoots makes dirs absolute and ensures they're directories, with no
+// dirs the working directory is the only root. A single _test.go file can be
+// given instead, its directory becomes the root and testFile is set.
+func resolveRoots(wd string, dirs []string) ([]string, error) {
+	if len(dirs) == 0 {
+		return []string{wd}, nil
+	}
+
+	var resolved []string
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(wd, dir)
+		}
+
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to stat watch root")
+		}
+		if !fi.IsDir() && isTestFileArg(dir) {
+			if len(dirs) != 1 {
+				return nil, errors.Errorf("a test file must be the only thing watched: %s", dir)
+			}
+			testFile = filepath.Clean(dir)
+			return []string{filepath.Dir(testFile)}, nil
+		}
+		if !fi.IsDir() {
+			return nil, errors.Errorf("watch root is not a directory: %s", dir)
+		}
+
+		resolved = append(resolved, filepath.Clean(dir))
+	}
+
+	return resolved, nil
+}
+
+func initWatches(roots []string) (*fsnotify.Watcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create watcher")
 	}
 
-	err = filepath.Walk(workingDir, func(path string, info os.FileInfo, err error) error {
+	start := time.Now()
+	for _, root := range roots {
+		if *flagGitignore {
+			if err := loadParentGitignores(root); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := addWatches(watcher, root); err != nil {
+			return nil, err
+		}
+	}
+
+	// A watch count far below the number walked means the ignore rules are
+	// doing their job, a slow walk on a big tree means they aren't
+	watchedMu.Lock()
+	count := len(watched)
+	watchedMu.Unlock()
+	infoln(fmt.Sprintf("Watching %d of %d directories (%s)", count, atomic.LoadInt64(&walkedDirs), time.Since(start).Round(time.Millisecond)))
+
+	return watcher, nil
+}
+
+// addWatches walks the tree rooted at root and adds a watch for every
+// directory in it.
+func addWatches(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return errors.Wrapf(err, "error occurred while walking: %s", path)
 		}
 
+		if *flagFollowSymlinks && info.Mode()&os.ModeSymlink != 0 {
+			return followSymlink(watcher, path)
+		}
 		if !info.IsDir() {
 			return nil
 		}
+		atomic.AddInt64(&walkedDirs, 1)
 
-		if filepath.Base(path) == "vendor" {
-			return nil
+		if isSkippedDir(path) {
+			debugln("Skipping:", path)
+			return filepath.SkipDir
+		}
+		if isIgnored(path) {
+			debugln("Ignoring:", path)
+			return filepath.SkipDir
+		}
+		// Watching a single test file only needs its own directory
+		if testFile != "" && path != filepath.Dir(testFile) {
+			return filepath.SkipDir
+		}
+
+		if *flagGitignore {
+			if err := loadGitignore(path); err != nil {
+				return err
+			}
 		}
 
+		watchedMu.Lock()
+		count := len(watched)
+		watchedMu.Unlock()
+
 		debugln("Adding watch:", path)
 		if err := watcher.Add(path); err != nil {
-			return errors.Wrap(err, "failed to add watch to %s")
+			return watchLimitError(err, path, count)
 		}
 
+		watchedMu.Lock()
+		watched[path] = struct{}{}
+		watchedMu.Unlock()
+
+		checkWatchCount(count + 1)
+
 		return nil
 	})
+}
+
+// runTestsForNewDir runs the tests for files that are already in a newly
+// created directory. Files written before its watch was added never produce
+// events, which is common when a tree is moved in and on Windows where
+// events arrive later.
+//
+// It has to be called after the watches are added. Then a file created at
+// any point is either found here or has an event of its own, at worst
+// both, and the queue only runs it once.
+func runTestsForNewDir(root string) error {
+	watchedMu.Lock()
+	var dirs []string
+	prefix := root + string(filepath.Separator)
+	for dir := range watched {
+		if dir == root || strings.HasPrefix(dir, prefix) {
+			dirs = append(dirs, dir)
+		}
+	}
+	watchedMu.Unlock()
+
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			debugln("failed to read new directory:", err)
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			if err := runTestsForFile(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isSkippedDir checks if path is, or is inside, a directory that's never
+// watched, from -rtest-skip-dirs or testdata. Only the part of path beneath
+// its watch root is looked at so rtest can still be run from inside a
+// vendor directory. Names are compared ignoring case since some filesystems
+// do too.
+func isSkippedDir(path string) bool {
+	for _, name := range strings.Split(filepath.ToSlash(pathInRoot(path)), "/") {
+		if isSkippedName(name) {
+			return true
+		}
+	}
 
+	return false
+}
+
+// isSkippedName checks a single directory name for isSkippedDir
+func isSkippedName(base string) bool {
+	// go ignores testdata and fixtures in it can be big and numerous, unless
+	// they're mapped to packages they're not worth watching
+	if !*flagWatchTestdata && len(flagMap) == 0 && strings.EqualFold(base, "testdata") {
+		return true
+	}
+
+	for _, name := range strings.Split(*flagSkipDirs, ",") {
+		if name = strings.TrimSpace(name); len(name) != 0 && strings.EqualFold(base, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pathInRoot makes path relative to the watch root it's in. Paths outside
+// the roots, like followed symlinks, are left with only their base name.
+func pathInRoot(path string) string {
+	for _, root := range roots {
+		if rel, err := filepath.Rel(root, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return rel
+		}
+	}
+
+	return filepath.Base(path)
+}
+
+// followSymlink watches the directory the symlink at path points to. Targets
+// that are already watched are skipped so links back up the tree can't loop.
+func followSymlink(watcher *fsnotify.Watcher, path string) error {
+	if isSkippedDir(path) || isIgnored(path) {
+		debugln("Ignoring:", path)
+		return nil
+	}
+
+	dest, err := filepath.EvalSymlinks(path)
 	if err != nil {
-		return nil, err
+		debugln("not following broken symlink:", path, err)
+		return nil
+	}
+	if info, err := os.Stat(dest); err != nil || !info.IsDir() {
+		return nil
 	}
 
-	return watcher, nil
+	watchedMu.Lock()
+	_, seen := watched[dest]
+	watchedMu.Unlock()
+	if seen {
+		debugln("already watching symlink target:", path, "->", dest)
+		return nil
+	}
+
+	debugln("Following symlink:", path, "->", dest)
+	return addWatches(watcher, dest)
+}
+
+// removeWatches removes the watch on path and every watch beneath it. The
+// kernel often removes watches on deleted directories by itself so failures
+// to remove are only logged.
+func removeWatches(watcher *fsnotify.Watcher, path string) {
+	watchedMu.Lock()
+	defer watchedMu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for dir := range watched {
+		if dir != path && !strings.HasPrefix(dir, prefix) {
+			continue
+		}
+
+		delete(watched, dir)
+
+		debugln("Removing watch:", dir)
+		if err := watcher.Remove(dir); err != nil {
+			debugln("watch already removed:", err)
+		}
+	}
 }
 
-func handleEvents(watcher *fsnotify.Watcher) error {
+// handleEvents handles file events until the watcher is closed. Errors are
+// reported and watching carries on, failing tests are never errors here so
+// anything that shows up is rtest's own problem.
+func handleEvents(watcher *fsnotify.Watcher) {
 	throttle := make(map[string]time.Time)
 
 	for {
 		select {
-		case err := <-watcher.Errors:
-			if err == nil {
-				return nil
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
 			}
 			debugln("watching error:", err)
-			return err
-		case ev := <-watcher.Events:
+			// The kernel's queue filled up and events were dropped, there's
+			// no telling what changed so everything is tested
+			if err == fsnotify.ErrEventOverflow {
+				warnln("file events were lost, running all tests")
+				if atomic.LoadInt32(&paused) == 0 {
+					if err := runTestsForDir(workingDir); err != nil {
+						errorln(err)
+					}
+				}
+				continue
+			}
+			errorln("watch error:", err)
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			// Writes to files that can't run tests, like a log being
+			// appended to, can be constant so they're dropped before doing
+			// anything else. Creates, removes and renames can be of
+			// directories which can't be told apart by name.
+			if ev.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 && !isSourceFile(ev.Name) {
+				continue
+			}
+
 			debugln("watcher event:", ev.Name, ev.Op.String())
+			idle.activity()
 
 			now := time.Now()
 			key := ev.Name + ":" + ev.Op.String()
 
-			t, ok := throttle[key]
-			if ok {
-				elapsed := now.Sub(t) / time.Millisecond
-				if elapsed < 800 {
-					debugln("skipping event, less than 800ms")
-					continue
+			if *flagDebounce > 0 && !*flagNoThrottle {
+				t, ok := throttle[key]
+				if ok {
+					elapsed := now.Sub(t)
+					if elapsed < *flagDebounce {
+						debugln("skipping event, less than", *flagDebounce)
+						continue
+					}
 				}
-			}
 
-			throttle[key] = now
+				throttle[key] = now
+
+				if len(throttle) > throttleSweepSize {
+					sweepThrottle(throttle, now, *flagDebounce)
+				}
+			}
 
 			if err := handleEvent(watcher, ev); err != nil {
-				return err
+				errorln(err)
 			}
 		}
 	}
 }
 
+// sweepThrottle removes the entries that are too old to hold back any more
+// events so the throttle map doesn't grow forever.
+func sweepThrottle(throttle map[string]time.Time, now time.Time, window time.Duration) {
+	for key, t := range throttle {
+		if now.Sub(t) >= window {
+			delete(throttle, key)
+		}
+	}
+
+	debugln("swept throttle, entries left:", len(throttle))
+}
+
 func handleEvent(watcher *fsnotify.Watcher, ev fsnotify.Event) error {
+	// Permissions and timestamps changing (touch, git checkout, chmod) don't
+	// change what the tests see
+	if ev.Op == fsnotify.Chmod {
+		debugln("ignoring chmod:", ev.Name)
+		return nil
+	}
+
+	// Packages coming and going, and imports changing, changes the import
+	// graph
+	if (*flagDeps || *flagWithHelpers || *flagOncePerPackage) && filepath.Ext(ev.Name) == ".go" {
+		if ev.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+			forgetImports(ev.Name)
+			invalidateDeps()
+		} else if ev.Op&fsnotify.Write == fsnotify.Write && importsChanged(ev.Name) {
+			debugln("imports changed:", ev.Name)
+			invalidateDeps()
+		}
+	}
+
+	if *flagRewatchOnBurst && ev.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+		burst.event(watcher)
+	}
+
 	switch {
 	case ev.Op&fsnotify.Create == fsnotify.Create:
 		// We don't care if it's a folder or not since if it's a file we're not going to
 		// watch it anyway, and if it's a file called vendor we're doubly not going to watch it.
 		// So we can do this before we know what kind of thing it is.
-		if base := filepath.Base(ev.Name); base == "vendor" {
+		if isSkippedDir(ev.Name) {
+			return nil
+		}
+		if isIgnored(ev.Name) {
+			debugln("Ignoring:", ev.Name)
 			return nil
 		}
 
 		fi, err := os.Stat(ev.Name)
-		if err != nil {
-			return errors.Wrapf(err, "failed to stat newly created file")
+		if os.IsNotExist(err) {
+			// Editors that save atomically write to a temp file and rename
+			// it over the real one, by the time we get here it's gone.
+			debugln("created file disappeared:", ev.Name)
+			return nil
+		} else if err != nil {
+			debugln("failed to stat newly created file:", err)
+			return nil
 		}
 
+		// A file renamed into a watched directory shows up as a Create, this
+		// is how atomic saves replace the original file without a Write. It's
+		// also the second half of a move and the only run for it.
 		if !fi.IsDir() {
+			renames.created(ev.Name)
 			return runTestsForFile(ev.Name)
 		}
 
-		debugln("Adding watch:", ev.Name)
-		if err := watcher.Add(ev.Name); err != nil {
-			return errors.Wrapf(err, "error removing watch on %s", ev.Name)
+		// Whole trees can show up at once (mv, tar -x, cp -r) and we only
+		// get an event for the top directory, so walk it for the rest.
+		if err := addWatches(watcher, ev.Name); err != nil {
+			return errors.Wrapf(err, "error adding watches to %s", ev.Name)
 		}
+		return runTestsForNewDir(ev.Name)
 	case ev.Op&fsnotify.Write == fsnotify.Write:
+		if isIgnored(ev.Name) {
+			debugln("Ignoring:", ev.Name)
+			return nil
+		}
+
+		// The file can be deleted or replaced by a directory before the
+		// event gets here, either way its own events will follow
+		if fi, err := os.Stat(ev.Name); err != nil {
+			debugln("written file can't be read:", err)
+			return nil
+		} else if fi.IsDir() {
+			debugln("written file is now a directory:", ev.Name)
+			return nil
+		}
+
 		if err := runTestsForFile(ev.Name); err != nil {
 			return err
 		}
-		// This code actually doesn't seem necessary. I guess when something is deleted the watch
-		// is probably autoremoved. Removing the watch manually like this caused problems in the past.
-		//
-		//case ev.Op&fsnotify.Remove == fsnotify.Remove || ev.Op&fsnotify.Rename == fsnotify.Rename:
-		/*debugln("Removing watch:", ev.Name)
-		if err := watcher.Remove(ev.Name); err != nil {
-			return errors.Wrapf(err, "error removing watch on %s", ev.Name)
-		}*/
+	case ev.Op&fsnotify.Remove == fsnotify.Remove || ev.Op&fsnotify.Rename == fsnotify.Rename:
+		removeWatches(watcher, ev.Name)
+		if *flagHash || *flagSkipTrivial {
+			forgetContents(ev.Name)
+		}
+		if ev.Op&fsnotify.Rename == fsnotify.Rename {
+			renames.renamed(ev.Name)
+		}
 	}
 
 	return nil
 }
 
+// loadIgnoreFile reads glob patterns from the .rtestignore file in dir if
+// there is one. Blank lines and lines starting with # are skipped.
+func loadIgnoreFile(dir string) error {
+	ignoreRoot = dir
+
+	file, err := os.Open(filepath.Join(dir, ignoreFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to open %s", ignoreFile)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pattern := strings.TrimSuffix(filepath.FromSlash(line), string(filepath.Separator))
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "bad pattern in %s: %s", ignoreFile, line)
+		}
+
+		debugln("Ignore pattern:", pattern)
+		ignorePatterns = append(ignorePatterns, pattern)
+	}
+
+	return errors.Wrapf(scanner.Err(), "failed to read %s", ignoreFile)
+}
+
+// isIgnored checks path against the ignore patterns, a pattern matches if
+// it matches either the base name of the path or the path relative to the
+// directory the ignore file was loaded from. With -rtest-gitignore the path
+// is also checked against the .gitignore files.
+func isIgnored(path string) bool {
+	if *flagGitignore && isGitignored(path) {
+		return true
+	}
+
+	if len(ignorePatterns) == 0 {
+		return false
+	}
+
+	base := filepath.Base(path)
+	rel, err := filepath.Rel(ignoreRoot, path)
+	if err != nil {
+		rel = path
+	}
+
+	for _, pattern := range ignorePatterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
 // handleEnter doesn't necessarily need to be done like this
 // we could get into stty calls and all that to hide echoing the output
 // etc. but we just do the naive thing.
-func handleEnter(wd string) {
+//
+// Each line is a command, an empty line or anything that isn't a command
+// runs the tests:
+//
+//	?  list the commands
+//	!  run the last command again exactly
+//	l  list the watched directories
+//	cd dir  only react to changes beneath dir, cd alone clears it
+//	p  pause, file changes are ignored
+//	r  resume
+//	q  quit
+func handleEnter(wd string, watcher *fsnotify.Watcher) {
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
-		if err := runTestsForDir(wd); err != nil {
-			fmt.Fprintln(os.Stderr, "error running go test", err)
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "/") {
+			pattern := strings.TrimPrefix(line, "/")
+			setMatchPattern(pattern)
+			saveState("match", pattern)
+			if pattern == "" {
+				fmt.Fprintln(os.Stderr, "Running all tests")
+			} else {
+				fmt.Fprintln(os.Stderr, "Only running tests matching:", pattern)
+			}
+			continue
+		}
+
+		if line == "cd" || strings.HasPrefix(line, "cd ") {
+			setScope(wd, strings.TrimSpace(strings.TrimPrefix(line, "cd")))
+			continue
+		}
+
+		switch line {
+		case "":
+			if err := runTestsForDir(wd); err != nil {
+				fmt.Fprintln(os.Stderr, "error running go test", err)
+			}
+		case "!":
+			if !replayLast() {
+				fmt.Fprintln(os.Stderr, "Nothing has run yet")
+			}
+		case "w":
+			rewatch(watcher)
+		case "l":
+			listWatches()
+		case "p":
+			atomic.StoreInt32(&paused, 1)
+			fmt.Fprintln(os.Stderr, "Paused, file changes are ignored")
+		case "r":
+			atomic.StoreInt32(&paused, 0)
+			fmt.Fprintln(os.Stderr, "Resumed")
+		case "q":
+			fmt.Fprintln(os.Stderr, "Quitting")
+			close(quit)
+			return
+		case "?":
+			fmt.Fprintln(os.Stderr, "Commands: <enter> run tests, ! rerun last, /pattern match tests, / match all, w rewatch, l list watches, cd dir scope changes, p pause, r resume, q quit, ? help")
+			if len(flagBind) != 0 {
+				fmt.Fprintln(os.Stderr, "Bound:", flagBind)
+			}
+		default:
+			if command, ok := flagBind[line]; ok {
+				runBinding(wd, command)
+				continue
+			}
+
+			// Anything else is taken as a request for the tests
+			if err := runTestsForDir(wd); err != nil {
+				fmt.Fprintln(os.Stderr, "error running go test", err)
+			}
 		}
 	}
 }
 
+// runBinding runs a command bound with -rtest-bind in the working directory
+// and waits for it, output is shown as it happens.
+func runBinding(wd, command string) {
+	infoln("Running:", command)
+
+	cmd := shellCommand(command)
+	cmd.Dir = wd
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = humanOutput()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		errorln(command, "failed:", err)
+	}
+}
+
+// setScope limits the changes that run tests to those beneath dir, an empty
+// dir clears it.
+func setScope(wd, dir string) {
+	if dir == "" {
+		scopeMu.Lock()
+		scope = ""
+		scopeMu.Unlock()
+		fmt.Fprintln(os.Stderr, "Reacting to changes everywhere")
+		return
+	}
+
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(wd, dir)
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		fmt.Fprintln(os.Stderr, "Not a directory:", dir)
+		return
+	}
+
+	dir = filepath.Clean(dir)
+	scopeMu.Lock()
+	scope = dir
+	scopeMu.Unlock()
+	fmt.Fprintln(os.Stderr, "Only reacting to changes in", relativeDir(dir))
+}
+
+// inScope checks if file is beneath the directory set with the cd command
+func inScope(file string) bool {
+	scopeMu.Lock()
+	defer scopeMu.Unlock()
+
+	return scope == "" || strings.HasPrefix(file, scope+string(filepath.Separator))
+}
+
+// listWatches prints the directories being watched, sorted
+func listWatches() {
+	watchedMu.Lock()
+	dirs := make([]string, 0, len(watched))
+	for dir := range watched {
+		dirs = append(dirs, relativeDir(dir))
+	}
+	watchedMu.Unlock()
+
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		fmt.Fprintln(os.Stderr, dir)
+	}
+	fmt.Fprintln(os.Stderr, len(dirs), "directories watched")
+}
+
+// runTestsForDir runs every package beneath each of the watch roots from dir,
+// as opposed to runTestsForFile which only tests the package that the file
+// belongs to.
 func runTestsForDir(dir string) error {
-	return runGoTest(dir)
+	if *flagRun != "" {
+		queue.push(serveTarget())
+		return nil
+	}
+
+	targets, err := rootsTargets(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range targets {
+		debugln("running tests recursively in:", t.dir, t.pkgs)
+		queue.push(t)
+	}
+	return nil
+}
+
+// rootsTargets creates the targets that test every package beneath each of
+// the watch roots, or just the package of the test file when watching one.
+// -rtest-target overrides both. Roots in the module dir is in are tested
+// from dir, go test only takes packages from one module so roots in other
+// modules are tested from their own module's root.
+func rootsTargets(dir string) ([]target, error) {
+	if *flagTarget != "" {
+		return []target{pinnedTarget()}, nil
+	}
+	// The same target runTestsForFile makes so the two can't queue twice
+	if testFile != "" {
+		return []target{{dir: filepath.Dir(testFile)}}, nil
+	}
+
+	dirModule := findModuleRoot(dir)
+
+	var targets []target
+	for _, root := range roots {
+		from := dir
+		if module := findModuleRoot(root); module != "" && module != dirModule {
+			from = module
+		}
+
+		rel, err := filepath.Rel(from, root)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to make %s relative", root)
+		}
+
+		pkg := "./..."
+		if rel != "." {
+			pkg = "./" + filepath.ToSlash(rel) + "/..."
+		}
+
+		found := false
+		for i := range targets {
+			if targets[i].dir == from {
+				targets[i].pkgs = append(targets[i].pkgs, pkg)
+				found = true
+				break
+			}
+		}
+		if !found {
+			targets = append(targets, target{dir: from, pkgs: []string{pkg}})
+		}
+	}
+
+	return targets, nil
+}
+
+// runOnce tests every package beneath the roots a single time without
+// watching anything and returns the exit code of the run.
+func runOnce(dir string) int {
+	targets, err := rootsTargets(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// Every module is tested, the first failure decides the exit code
+	exitCode := 0
+	for _, t := range targets {
+		run, err := runGoTest(t)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if run == nil {
+			continue
+		}
+
+		<-run.done
+		if exitCode == 0 {
+			exitCode = run.exitCode
+		}
+	}
+
+	return exitCode
+}
+
+// warmup builds every package beneath the roots once so that the first run
+// doesn't have to compile the whole dependency graph. Packages are listed
+// as they're built, failing to build is only a warning since the tests
+// will show the same errors.
+func warmup(dir string) {
+	targets, err := rootsTargets(dir)
+	if err != nil {
+		warnln("failed to warm up:", err)
+		return
+	}
+
+	infoln("Warming up the build cache")
+	start := time.Now()
+	for _, t := range targets {
+		args := []string{"build", "-v", "-o", os.DevNull}
+		if *flagTags != "" {
+			args = append(args, "-tags="+*flagTags)
+		}
+		args = append(args, t.pkgs...)
+
+		debugln("running: go", strings.Join(args, " "))
+		cmd := exec.Command(*flagGo, args...)
+		cmd.Dir = t.dir
+		cmd.Env = goEnv()
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			warnln("warm up failed:", err)
+			return
+		}
+	}
+	infoln("Warmed up in", time.Since(start).Round(time.Millisecond))
 }
 
 func runTestsForFile(file string) error {
 	filename := filepath.Base(file)
 	dir := filepath.Dir(file)
-	ext := filepath.Ext(filename)
 
-	if ext != ".go" {
+	if !isSourceFile(file) {
+		return nil
+	}
+	isMod := filename == "go.mod" || filename == "go.sum"
+	// Events are still handled while paused so new directories get
+	// watched, only the test runs are skipped
+	if atomic.LoadInt32(&paused) == 1 {
+		debugln("paused, not running tests for:", file)
+		return nil
+	}
+	if !inScope(file) {
+		debugln("outside of cd scope, not running tests for:", file)
+		return nil
+	}
+	if isRewriting() {
+		debugln("ignoring change made by go generate or go mod:", file)
+		return nil
+	}
+	if *flagHash && sameContents(file) {
+		debugln("contents unchanged, not running tests for:", file)
+		return nil
+	}
+	if *flagSkipTrivial && filepath.Ext(file) == ".go" && sameCode(file) {
+		debugln("only comments or formatting changed, not running tests for:", file)
+		return nil
+	}
+
+	if *flagRun != "" {
+		debugln("restarting:", *flagRun)
+		t := serveTarget()
+		t.mod = isMod
+		queue.push(t)
 		return nil
 	}
 
-	return runGoTest(dir)
-}
+	if *flagTarget != "" {
+		debugln("scheduling tests for pinned package:", *flagTarget)
+		t := pinnedTarget()
+		t.mod = isMod
+		queue.push(t)
+		return nil
+	}
 
-func runGoTest(dir string) error {
-	args := []string{"test"}
-	otherArgs := flag.Args()
-	args = append(args, otherArgs...)
+	if mapped := mappedPackages(file); len(mapped) != 0 {
+		debugln("file is mapped, scheduling tests for:", mapped)
+		for _, pkg := range mapped {
+			queueRun(workingDir, pkg)
+		}
+		return nil
+	}
 
-	debugln("running: go", strings.Join(args, " "))
+	// Dependencies changing can affect every package in the module
+	if isMod {
+		debugln("module changed, scheduling tests for:", dir)
+		queue.push(target{dir: dir, pkgs: []string{"./..."}, mod: true})
+		return nil
+	}
 
-	cmd := exec.Command("go", args...)
-	cmd.Dir = dir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// Editing tests is often writing ones that cross packages so -rtest-smart
+	// runs them all, editing code only runs its own package
+	if *flagAll || (*flagSmart && strings.HasSuffix(filename, "_test.go")) {
+		if root := findModuleRoot(dir); root != "" {
+			debugln("scheduling tests for whole module:", root)
+			queueRun(root, "./...")
+			return nil
+		}
+		return runTestsForDir(workingDir)
+	}
 
-	return cmd.Run()
+	debugln("scheduling tests for single package:", dir)
+	return scheduleDir(dir)
 }
 
-func debugln(args ...interface{}) {
-	if *flagDebug {
-		fmt.Fprintln(os.Stderr, args...)
+// isSourceFile checks if changes to file can run tests: files with the
+// -rtest-ext extensions, the module files, generator inputs and files mapped
+// to packages with -rtest-map.
+func isSourceFile(file string) bool {
+	filename := filepath.Base(file)
+	if filename == "go.mod" || filename == "go.sum" {
+		return true
 	}
+	if len(mappedPackages(file)) != 0 {
+		return true
+	}
+
+	ext := filepath.Ext(filename)
+	return inExtList(*flagExt, ext) || (*flagGenerate && inExtList(*flagGenerateExt, ext))
 }
 
-func debugf(format string, args ...interface{}) {
-	if *flagDebug {
-		fmt.Fprintf(os.Stderr, format, args...)
+// inExtList checks if ext is in a comma separated list of extensions
+func inExtList(list, ext string) bool {
+	for _, e := range strings.Split(list, ",") {
+		if strings.TrimSpace(e) == ext {
+			return true
+		}
 	}
+
+	return false
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// testTree creates a root with a package for each of pkgs, each with a go
+// file and a test, and points rtest at it. Runs are queued as soon as they're
+// scheduled and left in the queue for takeQueued.
+func testTree(t *testing.T, pkgs ...string) string {
+	t.Helper()
+
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range pkgs {
+		writeTestFile(t, filepath.Join(root, pkg, "code.go"), "package "+filepath.Base(pkg)+"\n")
+		writeTestFile(t, filepath.Join(root, pkg, "code_test.go"), "package "+filepath.Base(pkg)+"\n")
+	}
+
+	oldRoots, oldWorkingDir := roots, workingDir
+	oldCoalesce, oldDebounce := *flagCoalesce, *flagDebounce
+	t.Cleanup(func() {
+		roots, workingDir = oldRoots, oldWorkingDir
+		*flagCoalesce, *flagDebounce = oldCoalesce, oldDebounce
+		takeQueued()
+	})
+
+	roots, workingDir = []string{root}, root
+	*flagCoalesce, *flagDebounce = 0, 0
+	takeQueued()
+
+	return root
+}
+
+func writeTestFile(t *testing.T, path, contents string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// takeQueued empties the run queue and returns what was in it
+func takeQueued() []target {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	pending := queue.pending
+	queue.pending = nil
+	queue.queued = make(map[string]struct{})
+	return pending
+}
+
+func TestHandleEventAtomicSave(t *testing.T) {
+	root := testTree(t, "a")
+	file := filepath.Join(root, "a", "code.go")
+	temp := file + ".tmp"
+
+	// The editor writes a temp file and renames it over the original, the
+	// temp file's create is seen after it's already gone
+	writeTestFile(t, temp, "package a\n\nfunc A() {}\n")
+	if err := os.Rename(temp, file); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []fsnotify.Event{
+		{Name: temp, Op: fsnotify.Create},
+		{Name: temp, Op: fsnotify.Rename},
+		{Name: file, Op: fsnotify.Create},
+	}
+	for _, ev := range events {
+		if err := handleEvent(nil, ev); err != nil {
+			t.Errorf("%s: %v", ev, err)
+		}
+	}
+
+	queued := takeQueued()
+	if len(queued) != 1 {
+		t.Fatalf("want one run, got: %v", queued)
+	}
+	if want := filepath.Join(root, "a"); queued[0].dir != want {
+		t.Errorf("want a run in %s, got: %s", want, queued[0].dir)
+	}
+}
+
+func TestHandleEventWriteGone(t *testing.T) {
+	root := testTree(t, "a")
+
+	// Deleted before the write was handled
+	gone := filepath.Join(root, "a", "gone.go")
+	// Replaced by a directory before the write was handled
+	dir := filepath.Join(root, "a", "dir.go")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	feedEvents(t,
+		fsnotify.Event{Name: gone, Op: fsnotify.Write},
+		fsnotify.Event{Name: dir, Op: fsnotify.Write},
+	)
+
+	if queued := takeQueued(); len(queued) != 0 {
+		t.Errorf("want no runs, got: %v", queued)
+	}
+}
+
+func TestIsSkippedDir(t *testing.T) {
+	oldRoots, oldWatchTestdata := roots, *flagWatchTestdata
+	defer func() { roots, *flagWatchTestdata = oldRoots, oldWatchTestdata }()
+
+	tests := []struct {
+		root          string
+		path          string
+		watchTestdata bool
+		skipped       bool
+	}{
+		{root: "/src", path: "/src/a", skipped: false},
+		{root: "/src", path: "/src/a/vendor", skipped: true},
+		{root: "/src", path: "/src/a/vendor/b/c", skipped: true},
+		{root: "/src", path: "/src/a/Vendor/b", skipped: true},
+		{root: "/src/vendor", path: "/src/vendor", skipped: false},
+		{root: "/src/vendor", path: "/src/vendor/a/b", skipped: false},
+		{root: "/src/vendor", path: "/src/vendor/a/vendor/b", skipped: true},
+		{root: "/src", path: "/src/a/testdata/b", skipped: true},
+		{root: "/src", path: "/src/a/testdata/b", watchTestdata: true, skipped: false},
+		{root: "/src", path: "/elsewhere/vendor", skipped: true},
+		{root: "/src", path: "/elsewhere/vendor/a", skipped: false},
+	}
+
+	for _, test := range tests {
+		roots = []string{filepath.FromSlash(test.root)}
+		*flagWatchTestdata = test.watchTestdata
+
+		if skipped := isSkippedDir(filepath.FromSlash(test.path)); skipped != test.skipped {
+			t.Errorf("root %s, path %s, watch testdata %t: want skipped %t, got %t",
+				test.root, test.path, test.watchTestdata, test.skipped, skipped)
+		}
+	}
+}
+
+func TestHandleEventChmod(t *testing.T) {
+	root := testTree(t, "a")
+	file := filepath.Join(root, "a", "code.go")
+
+	feedEvents(t, fsnotify.Event{Name: file, Op: fsnotify.Chmod})
+	if queued := takeQueued(); len(queued) != 0 {
+		t.Errorf("want no runs for a chmod, got: %v", queued)
+	}
+
+	feedEvents(t, fsnotify.Event{Name: file, Op: fsnotify.Write | fsnotify.Chmod})
+	if queued := takeQueued(); len(queued) != 1 {
+		t.Errorf("want one run for a write and chmod, got: %v", queued)
+	}
+}
+
+func TestHandleEventNewTree(t *testing.T) {
+	root := testTree(t)
+
+	// The tree is built elsewhere and moved in so its files are there before
+	// any of it is watched, like mv or a slow watcher on windows
+	src := filepath.Join(t.TempDir(), "new")
+	for _, pkg := range []string{"a", "b", "b/c"} {
+		writeTestFile(t, filepath.Join(src, pkg, "code.go"), "package "+filepath.Base(pkg)+"\n")
+		writeTestFile(t, filepath.Join(src, pkg, "code_test.go"), "package "+filepath.Base(pkg)+"\n")
+	}
+	tree := filepath.Join(root, "new")
+	if err := os.Rename(src, tree); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	defer removeWatches(watcher, tree)
+
+	if err := handleEvent(watcher, fsnotify.Event{Name: tree, Op: fsnotify.Create}); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := make(map[string]int)
+	for _, q := range takeQueued() {
+		rel, err := filepath.Rel(tree, q.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs[filepath.ToSlash(rel)]++
+	}
+	if len(runs) != 3 || runs["a"] != 1 || runs["b"] != 1 || runs["b/c"] != 1 {
+		t.Errorf("want one run each for a, b and b/c, got: %v", runs)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// notify sends a desktop notification with the result of a test run in dir.
+// If the platform's notification tool can't be found nothing happens.
+func notify(dir string, passed bool) {
+	title := "rtest: " + dir
+	message := "FAIL"
+	if passed {
+		message = "PASS"
+	}
+
+	var name string
+	var args []string
+	switch runtime.GOOS {
+	case "darwin":
+		name = "osascript"
+		args = []string{"-e", fmt.Sprintf("display notification %s with title %s",
+			appleScriptQuote(message), appleScriptQuote(title))}
+	case "windows":
+		name = "powershell"
+		args = []string{"-NoProfile", "-NonInteractive", "-Command", windowsToast(title, message)}
+	default:
+		name = "notify-send"
+		args = []string{title, message}
+	}
+
+	if _, err := exec.LookPath(name); err != nil {
+		debugln("not sending notification:", err)
+		return
+	}
+
+	if err := exec.Command(name, args...).Run(); err != nil {
+		debugln("failed to send notification:", err)
+	}
+}
+
+func appleScriptQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+func powershellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// windowsToast creates a powershell script that pops up a toast.
+func windowsToast(title, message string) string {
+	const script = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode(%s)) > $null
+$text.Item(1).AppendChild($template.CreateTextNode(%s)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('rtest').Show([Windows.UI.Notifications.ToastNotification]::new($template))`
+
+	return fmt.Sprintf(script, powershellQuote(title), powershellQuote(message))
+}
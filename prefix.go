@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// inFlight counts the runs going at the same time
+var inFlight int32
+
+// prefixWriter puts a prefix in front of every line written through it so
+// the output of runs happening at the same time can be told apart. Only
+// whole lines are written, the last partial line is held until flush. With
+// -rtest-prefix auto lines are only prefixed while other runs are going.
+type prefixWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	prefix  []byte
+	auto    bool
+	partial []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix), auto: *flagPrefix == "auto"}
+}
+
+// prefixing checks if lines written now get the prefix
+func (p *prefixWriter) prefixing() bool {
+	return !p.auto || atomic.LoadInt32(&inFlight) > 1
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.partial = append(p.partial, b...)
+
+	var out []byte
+	prefixing := p.prefixing()
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		if prefixing {
+			out = append(out, p.prefix...)
+		}
+		out = append(out, p.partial[:i+1]...)
+		p.partial = p.partial[i+1:]
+	}
+
+	if len(out) != 0 {
+		if _, err := p.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// flush writes out what's left of an unterminated last line
+func (p *prefixWriter) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.partial) == 0 {
+		return
+	}
+
+	var out []byte
+	if p.prefixing() {
+		out = append(out, p.prefix...)
+	}
+	out = append(out, p.partial...)
+	_, _ = p.w.Write(append(out, '\n'))
+	p.partial = nil
+}
+
+// prefixOutput decides if run output goes through a prefixWriter, with auto
+// it's only needed when runs can happen at the same time.
+func prefixOutput() bool {
+	switch *flagPrefix {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return maxRuns() > 1
+	}
+}
+
+// outputLabel names a run in prefixed output by the packages it tests. A
+// go test of several packages can't say which one a line is from so they're
+// all named.
+func outputLabel(dir string, pkgs []string) string {
+	base := relativeDir(dir)
+	if len(pkgs) == 0 {
+		return "[" + base + "] "
+	}
+
+	labels := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		switch {
+		case pkg == ".":
+			labels[i] = base
+		case strings.HasPrefix(pkg, "./") && base != ".":
+			labels[i] = base + "/" + strings.TrimPrefix(pkg, "./")
+		default:
+			labels[i] = pkg
+		}
+	}
+	return "[" + strings.Join(labels, " ") + "] "
+}
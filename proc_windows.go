@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// setProcessGroup is a no-op on windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcess kills the command's process and every process it started.
+// Killing go.exe alone leaves the test binary it spawned running, taskkill
+// takes down the whole tree.
+func killProcess(cmd *exec.Cmd) error {
+	taskkill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	if err := taskkill.Run(); err != nil {
+		debugln("taskkill failed, killing only the process:", err)
+		return cmd.Process.Kill()
+	}
+
+	return nil
+}
+
+// shellCommand creates a command that runs command with cmd.exe.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
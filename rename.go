@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// renameWindow is how long a rename waits for the create of its new name,
+// the two events of a move arrive back to back
+const renameWindow = 100 * time.Millisecond
+
+// renames pairs up the two events of a file being moved
+var renames renameTracker
+
+// renameTracker holds on to the last file renamed so that when the create
+// of its new name follows the move only tests the new name once. A rename
+// with no create is a file moved out of the tree and its old package is
+// tested instead.
+type renameTracker struct {
+	mu    sync.Mutex
+	from  string
+	timer *time.Timer
+}
+
+// renamed records that file was renamed away. A rename that was already
+// waiting is taken to be a file moved away.
+func (r *renameTracker) renamed(file string) {
+	if !inExtList(*flagExt, filepath.Ext(file)) {
+		return
+	}
+
+	r.mu.Lock()
+	prev := r.take()
+	r.from = file
+	r.timer = time.AfterFunc(renameWindow, func() {
+		r.mu.Lock()
+		from := r.take()
+		r.mu.Unlock()
+
+		r.movedAway(from)
+	})
+	r.mu.Unlock()
+
+	r.movedAway(prev)
+}
+
+// created forgets the waiting rename when file is its new name, the create
+// runs the tests for the move.
+func (r *renameTracker) created(file string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.from == "" || !inExtList(*flagExt, filepath.Ext(file)) {
+		return
+	}
+
+	debugln("file moved:", r.from, "->", file)
+	r.take()
+}
+
+// take clears the waiting rename and returns it, r.mu must be held.
+func (r *renameTracker) take() string {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+
+	from := r.from
+	r.from = ""
+	return from
+}
+
+// movedAway tests the package a renamed file left.
+func (r *renameTracker) movedAway(file string) {
+	if file == "" {
+		return
+	}
+
+	debugln("file moved away:", file)
+	if err := runTestsForFile(file); err != nil {
+		errorln(err)
+	}
+}
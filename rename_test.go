@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// queuedDirs waits out any renames still waiting and returns the
+// directories of the queued runs
+func queuedDirs(t *testing.T, root string) []string {
+	t.Helper()
+
+	time.Sleep(3 * renameWindow)
+
+	var dirs []string
+	for _, q := range takeQueued() {
+		rel, err := filepath.Rel(root, q.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, filepath.ToSlash(rel))
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// feedEvents hands events to handleEvent as if they came from the watcher
+func feedEvents(t *testing.T, events ...fsnotify.Event) {
+	t.Helper()
+
+	for _, ev := range events {
+		if err := handleEvent(nil, ev); err != nil {
+			t.Errorf("%s: %v", ev, err)
+		}
+	}
+}
+
+func TestRenameThenCreate(t *testing.T) {
+	root := testTree(t, "a", "b")
+	from := filepath.Join(root, "a", "code.go")
+	to := filepath.Join(root, "b", "moved.go")
+	if err := os.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+
+	feedEvents(t,
+		fsnotify.Event{Name: from, Op: fsnotify.Rename},
+		fsnotify.Event{Name: to, Op: fsnotify.Create},
+	)
+
+	if dirs := queuedDirs(t, root); len(dirs) != 1 || dirs[0] != "b" {
+		t.Errorf("want one run for b, got: %v", dirs)
+	}
+}
+
+func TestRenameWithoutCreate(t *testing.T) {
+	root := testTree(t, "a")
+	from := filepath.Join(root, "a", "code.go")
+	if err := os.Rename(from, filepath.Join(t.TempDir(), "code.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	feedEvents(t, fsnotify.Event{Name: from, Op: fsnotify.Rename})
+
+	if dirs := queuedDirs(t, root); len(dirs) != 1 || dirs[0] != "a" {
+		t.Errorf("want one run for a, got: %v", dirs)
+	}
+}
+
+func TestRenameTwice(t *testing.T) {
+	root := testTree(t, "a", "b")
+
+	feedEvents(t,
+		fsnotify.Event{Name: filepath.Join(root, "a", "code.go"), Op: fsnotify.Rename},
+		fsnotify.Event{Name: filepath.Join(root, "b", "code.go"), Op: fsnotify.Rename},
+	)
+
+	if dirs := queuedDirs(t, root); len(dirs) != 2 || dirs[0] != "a" || dirs[1] != "b" {
+		t.Errorf("want runs for a and b, got: %v", dirs)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// resultLine matches the line go test prints when a test finishes, passes
+// and skips only show up with -v
+var resultLine = regexp.MustCompile(`^\s*--- (PASS|FAIL|SKIP): (\S+)`)
+
+// testResults picks the names of failing tests out of go test's output as
+// it's written, both the normal output and -json are understood. total is
+// how many tests finished, passing tests only show up with -v or -json so
+// counted is set when they did.
+type testResults struct {
+	partial []byte
+
+	failed  []string
+	total   int
+	counted bool
+	seen    map[string]bool
+}
+
+// testEvent is the part of a go test -json event that's needed
+type testEvent struct {
+	Action string
+	Test   string
+}
+
+func (r *testResults) Write(p []byte) (int, error) {
+	r.partial = append(r.partial, p...)
+
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		r.line(string(r.partial[:i]))
+		r.partial = r.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (r *testResults) line(line string) {
+	var action, name string
+	if strings.HasPrefix(line, "{") {
+		var ev testEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			return
+		}
+		action, name = ev.Action, ev.Test
+		r.counted = true
+	} else if m := resultLine.FindStringSubmatch(line); m != nil {
+		action, name = strings.ToLower(m[1]), m[2]
+	}
+
+	if action != "pass" && action != "fail" && action != "skip" {
+		return
+	}
+	if action != "fail" {
+		r.counted = true
+	}
+
+	// Only top level tests can be selected with -run so subtests are
+	// counted as their parent
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name = name[:i]
+	}
+	if len(name) == 0 {
+		return
+	}
+
+	if r.seen == nil {
+		r.seen = make(map[string]bool)
+	}
+	// A parent finishes after its subtests, so a failing subtest has already
+	// marked it failed by then
+	failed, ok := r.seen[name]
+	if !ok {
+		r.total++
+	}
+	if action == "fail" && !failed {
+		r.failed = append(r.failed, name)
+	}
+	r.seen[name] = failed || action == "fail"
+}
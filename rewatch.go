@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// burstSize directory creates and removes within burstWindow is taken
+	// to be something like a git checkout replacing the tree
+	burstSize   = 50
+	burstWindow = time.Second
+	// rewatchDelay is how long things have to be quiet after a burst
+	// before the watches are rebuilt
+	rewatchDelay = time.Second
+)
+
+// burst watches for bursts of creates and removes for -rtest-rewatch-on-burst
+var burst burstDetector
+
+type burstDetector struct {
+	mu    sync.Mutex
+	start time.Time
+	count int
+	timer *time.Timer
+}
+
+// event counts a create or remove, once there's been a burst of them the
+// watches are rebuilt after things settle down.
+func (b *burstDetector) event(watcher *fsnotify.Watcher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.start) > burstWindow {
+		b.start = now
+		b.count = 0
+	}
+	b.count++
+
+	if b.timer != nil {
+		b.timer.Reset(rewatchDelay)
+		return
+	}
+	if b.count < burstSize {
+		return
+	}
+
+	debugln("burst of file events, rebuilding watches once they stop")
+	b.timer = time.AfterFunc(rewatchDelay, func() {
+		b.mu.Lock()
+		b.timer = nil
+		b.count = 0
+		b.mu.Unlock()
+
+		rewatch(watcher)
+	})
+}
+
+// rewatch brings the watches up to date with the tree. Directories that
+// were missed are watched and ones that are gone are forgotten, existing
+// watches are left alone so no events are missed while it runs.
+func rewatch(watcher *fsnotify.Watcher) {
+	watchedMu.Lock()
+	for dir := range watched {
+		if _, err := os.Stat(dir); err != nil {
+			delete(watched, dir)
+			if err := watcher.Remove(dir); err != nil {
+				debugln("watch already removed:", err)
+			}
+		}
+	}
+	before := len(watched)
+	watchedMu.Unlock()
+
+	for _, root := range roots {
+		if err := addWatches(watcher, root); err != nil {
+			warnln("failed to rebuild watches:", err)
+		}
+	}
+
+	watchedMu.Lock()
+	after := len(watched)
+	watchedMu.Unlock()
+
+	infoln("Rebuilt watches, found", after-before, "new directories")
+}
@@ -0,0 +1,942 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// envArgs names the environment variable holding default go test arguments
+// that are used for every run, eg. RTEST_ARGS="-race -count=1"
+const envArgs = "RTEST_ARGS"
+
+var (
+	// runMu guards the test runs in flight, keyed by target, so that a new
+	// run can kill the one for the same target before it starts.
+	runMu   sync.Mutex
+	running = make(map[string]*testRun)
+
+	// lastRun is the most recent run with its full command line so that it
+	// can be run again exactly
+	lastMu  sync.Mutex
+	lastRun target
+
+	// matchMu guards -rtest-match which can be changed from stdin
+	matchMu sync.Mutex
+)
+
+// testRun is a test run that's been started, it can be made up of several
+// processes run one after another (eg. -rtest-pre then go test).
+type testRun struct {
+	dir  string
+	pkgs []string
+	key  string
+	// mod is set when go.mod changed and -rtest-mod should be run
+	mod bool
+	// start is when the run was started
+	start time.Time
+	// stamps are the packages being tested as they were when the run
+	// started, they're recorded if it passes for -rtest-once-per-package
+	stamps map[string]stamp
+	// timedOut is set when the run was killed by -rtest-timeout
+	timedOut int32
+	// exitCode is go test's exit code, it stays 1 when the tests could not
+	// be run
+	exitCode int
+
+	// focused is set when only previously failing tests are being run, and
+	// rerun is set when they pass so the whole target is run again
+	focused bool
+	rerun   bool
+
+	// results collects the failing tests from go test's output
+	results *testResults
+	// prefixed are the writers prefixing the output, if it is
+	prefixed []*prefixWriter
+
+	// jsonOut collects go test's output in -rtest-json mode
+	jsonOut *bytes.Buffer
+	// grouped holds the output back until the run finishes for -rtest-jobs
+	grouped *groupedOutput
+
+	// mu guards cmd which is the process that's currently running
+	mu  sync.Mutex
+	cmd *exec.Cmd
+
+	// killed is closed before the process is killed so that the results of
+	// a run that was cut short aren't reported.
+	killed chan struct{}
+	// done is closed once the process has exited and its results have
+	// been reported.
+	done chan struct{}
+}
+
+var (
+	// rewriting is set while a tool that changes source files is running
+	// (go generate, go mod tidy) and rewritten holds the time it last
+	// finished, changes it makes to files are ignored so they don't cause
+	// another run.
+	rewriting atomic.Value
+	rewritten atomic.Value
+)
+
+// rewriteGrace is how long after a tool finishes its changes are still
+// ignored since the events trickle in after the fact.
+const rewriteGrace = 500 * time.Millisecond
+
+// errKilled is returned when trying to exec a process in a killed run
+var errKilled = errors.New("test run was killed")
+
+// runGoTest runs go test in t.dir, t.pkgs are given to go test as package
+// arguments, when empty the package in dir is tested. If t has a command
+// line it's used as is, otherwise one is created by testCommand.
+//
+// The test process runs in the background, if a previous run of the same
+// target is still going when this is called it's killed first since its
+// results are stale. When every package is excluded by -rtest-exclude, or
+// unchanged with -rtest-once-per-package, nothing is run and the returned
+// run is nil.
+func runGoTest(t target) (*testRun, error) {
+	dir, pkgs := t.dir, t.pkgs
+	key := t.key()
+
+	var name string
+	var args []string
+	var focused bool
+	if len(t.argv) != 0 {
+		name, args = t.argv[0], t.argv[1:]
+	} else {
+		if *flagFuzz != "" && !fuzzable(pkgs) {
+			return nil, errors.Errorf("-rtest-fuzz can only fuzz one package at a time, not %s, change a file in the package to fuzz instead", strings.Join(pkgs, " "))
+		}
+
+		if *flagRun == "" {
+			var skip bool
+			var err error
+			if pkgs, skip, err = excludePackages(dir, pkgs); err != nil {
+				return nil, err
+			}
+			if skip {
+				debugln("every package is excluded:", key)
+				return nil, nil
+			}
+			if *flagOncePerPackage {
+				if pkgs, skip, err = changedPackages(dir, pkgs); err != nil {
+					return nil, err
+				}
+				if skip {
+					debugln("every package is unchanged since it last passed:", key)
+					return nil, nil
+				}
+			}
+			if *flagBuild && len(buildablePackages(dir, pkgs)) == 0 {
+				debugln("only tests, nothing to build:", key)
+				return nil, nil
+			}
+		}
+
+		name, args, focused = testCommand(dir, pkgs)
+		if *flagExecPrefix != "" {
+			name, args = prefixCommand(*flagExecPrefix, dir, append([]string{name}, args...))
+		}
+	}
+
+	lastMu.Lock()
+	lastRun = target{dir: dir, pkgs: pkgs, mod: t.mod, argv: append([]string{name}, args...)}
+	lastMu.Unlock()
+
+	debugln("running:", name, strings.Join(args, " "))
+
+	if *flagDryRun {
+		fmt.Fprintf(os.Stderr, "would run in %s: %s %s\n", relativeDir(dir), name, strings.Join(args, " "))
+		run := &testRun{dir: dir, pkgs: pkgs, key: key, done: make(chan struct{})}
+		close(run.done)
+		return run, nil
+	}
+
+	var jsonOut *bytes.Buffer
+	var grouped *groupedOutput
+	var prefixed []*prefixWriter
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = goEnv()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if groupOutput() {
+		grouped = new(groupedOutput)
+		cmd.Stdout, cmd.Stderr = &grouped.stdout, &grouped.stderr
+	}
+	if prefixOutput() {
+		label := outputLabel(dir, pkgs)
+		stdout, stderr := newPrefixWriter(cmd.Stdout, label), newPrefixWriter(cmd.Stderr, label)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		prefixed = []*prefixWriter{stdout, stderr}
+	}
+	if *flagJSON && *flagRun == "" {
+		jsonOut = new(bytes.Buffer)
+		cmd.Stdout = jsonOut
+	}
+	results := new(testResults)
+	if *flagFocusFails || !*flagNoDigest {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, results)
+	}
+
+	runMu.Lock()
+	// With -rtest-no-throttle every run is seen through, the wait can't hold
+	// runMu since everything else that looks at the runs needs it
+	for seeThrough() {
+		prev, ok := running[key]
+		if !ok {
+			break
+		}
+
+		runMu.Unlock()
+		<-prev.done
+		runMu.Lock()
+		if running[key] == prev {
+			break
+		}
+	}
+	defer runMu.Unlock()
+
+	stopRunning(key)
+
+	// Clearing would wipe out the event information we just printed unless
+	// it went to a file, or the output of other runs still going, and in
+	// json mode stdout is for machines
+	debugOnScreen := *flagDebug && *flagDebugFile == ""
+	if *flagClear && !debugOnScreen && !*flagJSON && len(running) == 0 {
+		clearScreen()
+	}
+	if !*flagNoHeader {
+		// go test only caches results when it's given packages, which
+		// testCommand only does for go itself, and all of its flags are
+		// cacheable, these are the ones rtest might add that aren't
+		uncached := hasFlag(args, "count") || hasFlag(args, "bench") || hasFlag(args, "fuzz")
+		uncached = uncached || (len(pkgs) == 0 && (*flagCmd != "" || *flagExecPrefix != ""))
+		printHeader(dir, pkgs, uncached)
+	}
+	if *flagEchoCmd {
+		printCommand(dir, name, args)
+	}
+
+	var stamps map[string]stamp
+	if *flagOncePerPackage && len(t.argv) == 0 {
+		stamps = runStamps(dir, pkgs)
+	}
+
+	run := &testRun{
+		dir:      dir,
+		pkgs:     pkgs,
+		key:      key,
+		mod:      t.mod,
+		focused:  focused,
+		jsonOut:  jsonOut,
+		grouped:  grouped,
+		results:  results,
+		prefixed: prefixed,
+		stamps:   stamps,
+		start:    time.Now(),
+		exitCode: 1,
+		killed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	running[key] = run
+	atomic.AddInt32(&inFlight, 1)
+	sock.send(runEvent{Event: "started", Dir: dir, Packages: pkgs, Start: run.start})
+	go run.run(cmd)
+
+	return run, nil
+}
+
+// testCommand creates the command line for testing pkgs in dir. With
+// -rtest-build the packages are only compiled with go build, the go test
+// arguments are still passed along so they should be build flags. The
+// focused return is set when only previously failing tests will run.
+func testCommand(dir string, pkgs []string) (name string, args []string, focused bool) {
+	// In run mode the arguments after -- are for the program
+	if *flagRun != "" {
+		args = append([]string{"run"}, pkgs...)
+		return *flagGo, append(args, testArgs...), false
+	}
+
+	// Defaults from the config file, the environment and -rtest-goflags go
+	// before the command line arguments so that when a flag is given more
+	// than once the command line wins.
+	otherArgs := append([]string(nil), configArgs...)
+	otherArgs = append(otherArgs, strings.Fields(os.Getenv(envArgs))...)
+	otherArgs = append(otherArgs, strings.Fields(*flagGoFlags)...)
+	otherArgs = append(otherArgs, testArgs...)
+
+	// Flags rtest adds itself are left out when the user already gave them,
+	// including through GOFLAGS which go applies underneath everything.
+	given := append(strings.Fields(os.Getenv("GOFLAGS")), otherArgs...)
+
+	subcommand := "test"
+	if *flagBuild {
+		subcommand = "build"
+	}
+
+	args = []string{subcommand}
+	if *flagBuild {
+		// Without -o go build leaves a binary behind for main packages
+		args = append(args, "-o", os.DevNull)
+	}
+	if *flagVerbose && !hasFlag(given, "v") {
+		args = append(args, "-v")
+	}
+	if *flagTags != "" && !hasFlag(given, "tags") {
+		args = append(args, "-tags="+*flagTags)
+		debugln("build tags:", *flagTags)
+	}
+
+	key := target{dir: dir, pkgs: pkgs}.key()
+	if !*flagBuild {
+		if *flagJSON && !hasFlag(given, "json") {
+			args = append(args, "-json")
+		}
+
+		// -count=1 is the documented way to skip go test's result cache
+		if *flagNoCache && !hasFlag(given, "count") {
+			args = append(args, "-count=1")
+		}
+
+		match := matchPattern()
+		if match == "" && testFile != "" {
+			match = fileTestsPattern(testFile)
+		}
+		if len(flagBench) != 0 {
+			args = append(args, "-bench="+string(flagBench))
+			// Tests are skipped unless asked for with -run
+			if !hasFlag(given, "run") && match == "" {
+				args = append(args, "-run=^$")
+			}
+		}
+
+		if *flagFuzz != "" {
+			args = append(args, "-fuzz="+*flagFuzz)
+			if !hasFlag(given, "fuzztime") {
+				args = append(args, "-fuzztime="+flagFuzzTime.String())
+			}
+		}
+
+		if match != "" && !hasFlag(given, "run") {
+			args = append(args, "-run", match)
+		} else if *flagFocusFails && !hasFlag(given, "run") {
+			if pattern := focusRunArg(key); len(pattern) != 0 {
+				debugln("only running failed tests:", pattern)
+				args = append(args, "-run", pattern)
+				focused = true
+			}
+		}
+	}
+	// go build refuses packages that are only tests
+	if *flagBuild {
+		pkgs = buildablePackages(dir, pkgs)
+	}
+	// Without package arguments go test runs in local directory mode, where
+	// results are never cached. Other commands get the arguments as they are
+	// since . could mean anything to them.
+	if len(pkgs) == 0 && *flagCmd == "" && *flagExecPrefix == "" {
+		args = append(args, ".")
+	} else {
+		args = append(args, pkgs...)
+	}
+	args = append(args, otherArgs...)
+
+	name = *flagGo
+	if *flagCmd != "" {
+		name, args = customCommand(*flagCmd, dir, args[1:])
+	}
+
+	return name, args, focused
+}
+
+// run runs the pre command if there is one, then the tests, and reports
+// how it went.
+func (t *testRun) run(test *exec.Cmd) {
+	defer close(t.done)
+	defer atomic.AddInt32(&inFlight, -1)
+	defer t.sendKilled()
+
+	if *flagTimeout > 0 {
+		defer t.reportTimeout()
+		timer := time.AfterFunc(*flagTimeout, func() {
+			atomic.StoreInt32(&t.timedOut, 1)
+			t.kill()
+		})
+		defer timer.Stop()
+	}
+
+	if *flagPre != "" {
+		debugln("running pre command:", *flagPre)
+		if !t.step("pre command", shellCommand(*flagPre)) {
+			return
+		}
+	}
+
+	if t.mod && *flagMod != "" {
+		debugln("running: go mod", *flagMod)
+		if !t.rewriteStep("go mod "+*flagMod, exec.Command(*flagGo, "mod", *flagMod)) {
+			return
+		}
+	}
+
+	if *flagGenerate {
+		args := append([]string{"generate"}, t.pkgs...)
+		debugln("running: go", strings.Join(args, " "))
+
+		if !t.rewriteStep("go generate", exec.Command(*flagGo, args...)) {
+			return
+		}
+	}
+
+	// go build stops at the first broken package and prints far less than
+	// go test does for every package it couldn't build
+	if *flagBuildGate && !*flagBuild && *flagRun == "" {
+		if pkgs := buildablePackages(t.dir, t.pkgs); len(pkgs) != 0 {
+			args := []string{"build", "-o", os.DevNull}
+			if *flagTags != "" {
+				args = append(args, "-tags="+*flagTags)
+			}
+			args = append(args, pkgs...)
+			debugln("running: go", strings.Join(args, " "))
+
+			build := exec.Command(*flagGo, args...)
+			build.Env = goEnv()
+			if !t.step("build", build) {
+				return
+			}
+		} else {
+			debugln("only tests, nothing to build first:", t.key)
+		}
+	}
+
+	start := time.Now()
+	err := t.exec(test)
+	attempts := 1
+	for ; attempts <= *flagRetry && isTestFailure(err) && !t.wasKilled(); attempts++ {
+		infoln(fmt.Sprintf("Tests failed, retrying (%d of %d)", attempts, *flagRetry))
+
+		// Only the last attempt's results count
+		*t.results = testResults{}
+		if t.jsonOut != nil {
+			t.jsonOut.Reset()
+		}
+
+		test = cloneCommand(test)
+		err = t.exec(test)
+	}
+	elapsed := time.Since(start)
+	for _, w := range t.prefixed {
+		w.flush()
+	}
+	if t.wasKilled() {
+		return
+	}
+
+	if _, ok := err.(*exec.ExitError); ok {
+		debugln("go test exited:", err)
+	} else if err != nil {
+		if t.grouped != nil {
+			groupMu.Lock()
+			t.grouped.flush()
+			groupMu.Unlock()
+		}
+		fmt.Fprintln(os.Stderr, "error running go test", err)
+		t.post()
+		return
+	}
+	t.exitCode = test.ProcessState.ExitCode()
+
+	if !t.post() {
+		return
+	}
+
+	if t.jsonOut != nil {
+		if err := writeJSONRun(os.Stdout, t, start, elapsed, t.exitCode); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to write json:", err)
+		}
+	}
+
+	// The output, digest and footer go out together
+	if t.grouped != nil {
+		groupMu.Lock()
+		defer groupMu.Unlock()
+		t.grouped.flush()
+	}
+
+	if !*flagNoDigest {
+		total := 0
+		if t.results.counted {
+			total = t.results.total
+		}
+		printDigest(t.results.failed, total)
+	}
+	printFooter(t.dir, err == nil, elapsed, attempts)
+	t.report(err == nil)
+
+	// Focused runs leave out tests so they don't count
+	if err == nil && !t.focused {
+		recordStamps(t.stamps)
+	}
+
+	if *flagFocusFails {
+		t.rerun = updateFocus(t.key, t.focused, err == nil, t.results.failed)
+	}
+}
+
+// buildablePackages leaves out the packages in dir that are only tests, go
+// build refuses to build them. Patterns and import paths are kept since
+// there's no telling what they match without asking go.
+func buildablePackages(dir string, pkgs []string) []string {
+	if len(pkgs) == 0 {
+		pkgs = []string{"."}
+	}
+
+	var keep []string
+	for _, pkg := range pkgs {
+		local := pkg == "." || strings.HasPrefix(pkg, "./") || strings.HasPrefix(pkg, "../")
+		if !local || strings.Contains(pkg, "...") || hasNonTestFiles(filepath.Join(dir, pkg)) {
+			keep = append(keep, pkg)
+		}
+	}
+
+	return keep
+}
+
+// hasNonTestFiles checks if dir has go files that aren't tests
+func hasNonTestFiles(dir string) bool {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, match := range matches {
+		if !strings.HasSuffix(match, "_test.go") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fuzzable checks if go test can fuzz pkgs, it refuses more than one
+// package or a pattern that could match more than one.
+func fuzzable(pkgs []string) bool {
+	return len(pkgs) == 0 || (len(pkgs) == 1 && !strings.Contains(pkgs[0], "..."))
+}
+
+// goEnv is the environment for go commands, it's nil to use rtest's own
+// unless -rtest-goos or -rtest-goarch change the target platform.
+func goEnv() []string {
+	if *flagGOOS == "" && *flagGOARCH == "" {
+		return nil
+	}
+
+	// exec uses the last value when a variable is set twice
+	env := os.Environ()
+	if *flagGOOS != "" {
+		env = append(env, "GOOS="+*flagGOOS)
+	}
+	if *flagGOARCH != "" {
+		env = append(env, "GOARCH="+*flagGOARCH)
+	}
+	return env
+}
+
+// isTestFailure checks if err is go test exiting with a failure, as opposed
+// to not running at all.
+func isTestFailure(err error) bool {
+	_, ok := err.(*exec.ExitError)
+	return ok
+}
+
+// cloneCommand creates a command that can run cmd again, a command can only
+// be started once.
+func cloneCommand(cmd *exec.Cmd) *exec.Cmd {
+	clone := exec.Command(cmd.Path, cmd.Args[1:]...)
+	clone.Dir = cmd.Dir
+	clone.Env = cmd.Env
+	clone.Stdin = cmd.Stdin
+	clone.Stdout = cmd.Stdout
+	clone.Stderr = cmd.Stderr
+	return clone
+}
+
+// post runs the -rtest-post command after the tests whether they passed or
+// not. Its failure is only reported, it doesn't change the test result. It
+// returns false if the run was killed while it ran.
+func (t *testRun) post() bool {
+	if *flagPost == "" {
+		return true
+	}
+
+	debugln("running post command:", *flagPost)
+	cmd := shellCommand(*flagPost)
+	cmd.Dir = t.dir
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := t.exec(cmd); err != nil {
+		if t.wasKilled() {
+			return false
+		}
+		fmt.Fprintln(os.Stderr, "post command failed:", err)
+	}
+
+	return true
+}
+
+// sendKilled lets -rtest-sock clients know the run was killed before it
+// finished because something newer replaced it, timeouts are reported as
+// failures instead.
+func (t *testRun) sendKilled() {
+	select {
+	case <-t.killed:
+	default:
+		return
+	}
+
+	if atomic.LoadInt32(&t.timedOut) == 0 {
+		sock.send(runEvent{Event: "killed", Dir: t.dir, Packages: t.pkgs, Start: t.start})
+	}
+}
+
+// reportTimeout tells the user when the run was killed for taking longer
+// than -rtest-timeout, it's reported as a failure.
+func (t *testRun) reportTimeout() {
+	if atomic.LoadInt32(&t.timedOut) == 0 {
+		return
+	}
+
+	// What the run was doing when it hung is the most useful part
+	if t.grouped != nil {
+		groupMu.Lock()
+		defer groupMu.Unlock()
+		t.grouped.flush()
+	}
+
+	fmt.Fprintf(os.Stderr, "test run timed out after %s\n", *flagTimeout)
+	printFooter(t.dir, false, *flagTimeout, 1)
+	t.report(false)
+}
+
+// step runs a command in the run's directory that must succeed for the tests
+// to be run. If it fails the run is reported as a failure.
+func (t *testRun) step(name string, cmd *exec.Cmd) bool {
+	cmd.Dir = t.dir
+	cmd.Stdout = humanOutput()
+	cmd.Stderr = os.Stderr
+
+	if err := t.exec(cmd); err != nil {
+		if t.wasKilled() {
+			return false
+		}
+
+		fmt.Fprintf(os.Stderr, "%s failed, not running tests: %v\n", name, err)
+		t.report(false)
+		return false
+	}
+
+	return true
+}
+
+// prefixCommand puts the -rtest-exec-prefix command in front of cmd so it
+// can be run somewhere else, like a container. Environment variables in the
+// prefix are expanded, {dir} is the directory being tested and {rel} is that
+// directory relative to the working directory for mapping it into the other
+// environment. cmd goes where {args} is or at the end.
+func prefixCommand(prefix, dir string, cmd []string) (string, []string) {
+	rel, err := filepath.Rel(workingDir, dir)
+	if err != nil {
+		rel = dir
+	}
+
+	prefix = strings.Replace(os.ExpandEnv(prefix), "{rel}", filepath.ToSlash(rel), -1)
+	return customCommand(prefix, dir, cmd)
+}
+
+// matchPattern is the -rtest-match pattern given to go test's -run.
+func matchPattern() string {
+	matchMu.Lock()
+	defer matchMu.Unlock()
+
+	return *flagMatch
+}
+
+// setMatchPattern changes the -rtest-match pattern, empty clears it.
+func setMatchPattern(pattern string) {
+	matchMu.Lock()
+	defer matchMu.Unlock()
+
+	*flagMatch = pattern
+}
+
+// rewriteStep is a step that changes source files, changes to files while
+// it runs are ignored.
+func (t *testRun) rewriteStep(name string, cmd *exec.Cmd) bool {
+	rewriting.Store(true)
+	defer func() {
+		rewritten.Store(time.Now())
+		rewriting.Store(false)
+	}()
+
+	return t.step(name, cmd)
+}
+
+// exec runs cmd to completion as part of the test run.
+func (t *testRun) exec(cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+
+	t.mu.Lock()
+	select {
+	case <-t.killed:
+		t.mu.Unlock()
+		return errKilled
+	default:
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.mu.Unlock()
+		return errors.Wrapf(err, "failed to start %s", cmd.Path)
+	}
+	t.cmd = cmd
+	t.mu.Unlock()
+
+	err := cmd.Wait()
+
+	t.mu.Lock()
+	t.cmd = nil
+	t.mu.Unlock()
+
+	return err
+}
+
+// kill stops the run, the process running now is killed and nothing else
+// will be started. It's safe to call more than once.
+func (t *testRun) kill() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case <-t.killed:
+		return
+	default:
+	}
+
+	close(t.killed)
+	if t.cmd == nil {
+		return
+	}
+
+	if err := killProcess(t.cmd); err != nil {
+		debugln("failed to kill test run:", err)
+	}
+}
+
+func (t *testRun) wasKilled() bool {
+	select {
+	case <-t.killed:
+		debugln("test run killed:", t.dir)
+		return true
+	default:
+		return false
+	}
+}
+
+// report records how the run went and lets the user know.
+func (t *testRun) report(passed bool) {
+	code := t.exitCode
+	if passed {
+		code = 0
+	}
+	recordRun(t, passed, code)
+	alert := statusChanged(t.key, passed) || !*flagNotifyOnChange
+
+	result := newRunResult(t.start, time.Now(), passed, code)
+	if t.results != nil {
+		result.Failed = t.results.failed
+	}
+	sock.send(runEvent{Event: "finished", Dir: t.dir, Packages: t.pkgs, Start: t.start, runResult: result})
+
+	if *flagBell && !passed && alert {
+		fmt.Fprint(os.Stderr, "\a")
+	}
+	if *flagNotify && alert {
+		notify(t.dir, passed)
+	}
+}
+
+// seeThrough checks if runs are left to finish rather than being killed when
+// they're replaced. Programs started with -rtest-run never finish so they're
+// always restarted.
+func seeThrough() bool {
+	return *flagNoThrottle && *flagRun == ""
+}
+
+// stopRunning kills the run for key if there is one and waits for it to
+// exit so its output can't interleave with whatever runs next. runMu must be
+// held.
+func stopRunning(key string) {
+	run, ok := running[key]
+	if !ok {
+		return
+	}
+
+	select {
+	case <-run.done:
+	default:
+		debugln("killing in-flight test run:", key)
+		run.kill()
+		<-run.done
+	}
+
+	delete(running, key)
+}
+
+// killRunning kills the run for key without waiting for it to exit, with an
+// empty key every run is killed.
+func killRunning(key string) {
+	runMu.Lock()
+	defer runMu.Unlock()
+
+	for k, run := range running {
+		if key != "" && k != key {
+			continue
+		}
+
+		select {
+		case <-run.done:
+		default:
+			debugln("killing in-flight test run:", k)
+			run.kill()
+		}
+	}
+}
+
+// isRunning checks if any runs are in flight.
+func isRunning() bool {
+	runMu.Lock()
+	defer runMu.Unlock()
+
+	for _, run := range running {
+		select {
+		case <-run.done:
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+// finishRun forgets about run once it's done, unless it's already been
+// replaced by a newer run of the same target.
+func finishRun(run *testRun) {
+	<-run.done
+
+	runMu.Lock()
+	if running[run.key] == run {
+		delete(running, run.key)
+	}
+	runMu.Unlock()
+}
+
+// shutdownRunning gives the running tests up to timeout to finish and then
+// kills them so no test processes are left behind when rtest exits.
+func shutdownRunning(timeout time.Duration) {
+	runMu.Lock()
+	defer runMu.Unlock()
+
+	if timeout > 0 {
+		deadline := time.After(timeout)
+	wait:
+		for _, run := range running {
+			select {
+			case <-run.done:
+			case <-deadline:
+				fmt.Fprintln(os.Stderr, "Tests still running after", timeout)
+				break wait
+			}
+		}
+	}
+
+	for key := range running {
+		stopRunning(key)
+	}
+}
+
+// customCommand fills out the -rtest-cmd template. {dir} is replaced with
+// the directory being tested and {args} with the arguments that would have
+// been given to go test after "test", if there's no {args} they're added to
+// the end.
+func customCommand(template, dir string, testArgs []string) (string, []string) {
+	fields := strings.Fields(template)
+
+	var args []string
+	var sawArgs bool
+	for _, field := range fields[1:] {
+		if field == "{args}" {
+			sawArgs = true
+			args = append(args, testArgs...)
+			continue
+		}
+
+		args = append(args, strings.Replace(field, "{dir}", dir, -1))
+	}
+
+	if !sawArgs {
+		args = append(args, testArgs...)
+	}
+
+	return strings.Replace(fields[0], "{dir}", dir, -1), args
+}
+
+// isRewriting checks if a tool that changes source files is running or just
+// finished, in which case changes to files are likely its doing.
+func isRewriting() bool {
+	if b, _ := rewriting.Load().(bool); b {
+		return true
+	}
+
+	t, _ := rewritten.Load().(time.Time)
+	return time.Since(t) < rewriteGrace
+}
+
+// hasFlag checks if the flag name is present in args in any of the forms
+// the flag package accepts: -name, --name, -name=value, --name=value
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == "--" || arg == "-args" {
+			break
+		}
+
+		arg = strings.TrimPrefix(arg, "-")
+		arg = strings.TrimPrefix(arg, "-")
+		if arg == name || strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clearScreen clears the terminal, windows' console doesn't reliably
+// understand ansi escapes so it gets cls instead.
+func clearScreen() {
+	if runtime.GOOS == "windows" {
+		cmd := exec.Command("cmd", "/c", "cls")
+		cmd.Stdout = os.Stdout
+		_ = cmd.Run()
+		return
+	}
+
+	fmt.Fprint(os.Stdout, "\033[2J\033[H")
+}
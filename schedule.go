@@ -0,0 +1,398 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// batch collects the directories that need testing while a burst of events
+// is still coming in so that they can all be tested with a single run once
+// things settle down.
+var batch batcher
+
+// dirBatches hold back runs for each changed directory when -rtest-coalesce
+// is off so a burst of saves in one package within the debounce window is
+// still a single run.
+var (
+	dirBatchesMu sync.Mutex
+	dirBatches   = make(map[string]*batcher)
+)
+
+type batcher struct {
+	mu    sync.Mutex
+	dirs  map[string]struct{}
+	timer *time.Timer
+}
+
+// scheduleDir asks for the package in dir to be tested. With -rtest-coalesce
+// the run is held back until no more directories have been scheduled for
+// the coalesce window.
+//
+// With -rtest-deps the packages that import the package in dir are tested
+// as well, with -rtest-with-helpers only the ones whose tests import it when
+// nothing else does.
+func scheduleDir(dir string) error {
+	dirs := []string{dir}
+	if *flagDeps {
+		var err error
+		if dirs, err = dependentDirs(dir); err != nil {
+			return err
+		}
+		debugln("packages depending on", dir, dirs[1:])
+	} else if *flagWithHelpers {
+		var err error
+		if dirs, err = helperDirs(dir); err != nil {
+			return err
+		}
+		if len(dirs) > 1 {
+			debugln("packages whose tests use", dir, dirs[1:])
+		}
+	}
+
+	if dirs = withoutExcluded(dirs); len(dirs) == 0 {
+		return nil
+	}
+
+	// Packages without tests still need building
+	if !*flagIncludeNoTest && !*flagBuild {
+		dirs = withTests(dirs)
+		if len(dirs) == 0 {
+			debugln("no test files, skipping:", dir)
+			return nil
+		}
+	}
+
+	if *flagNoThrottle {
+		return runDirs(dirs)
+	}
+
+	if *flagCoalesce <= 0 {
+		if *flagDebounce <= 0 {
+			return runDirs(dirs)
+		}
+
+		b := dirBatch(dir)
+		for _, d := range dirs {
+			b.add(d, *flagDebounce)
+		}
+		return nil
+	}
+
+	for _, d := range dirs {
+		batch.add(d, *flagCoalesce)
+	}
+	return nil
+}
+
+// dirBatch returns the batch for changes to dir.
+func dirBatch(dir string) *batcher {
+	dirBatchesMu.Lock()
+	defer dirBatchesMu.Unlock()
+
+	b, ok := dirBatches[dir]
+	if !ok {
+		b = new(batcher)
+		dirBatches[dir] = b
+	}
+	return b
+}
+
+func (b *batcher) add(dir string, wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.dirs == nil {
+		b.dirs = make(map[string]struct{})
+	}
+	b.dirs[dir] = struct{}{}
+
+	if b.timer == nil {
+		b.timer = time.AfterFunc(wait, b.flush)
+	} else {
+		b.timer.Reset(wait)
+	}
+}
+
+func (b *batcher) flush() {
+	b.mu.Lock()
+	dirs := make([]string, 0, len(b.dirs))
+	for dir := range b.dirs {
+		dirs = append(dirs, dir)
+	}
+	b.dirs = nil
+	b.mu.Unlock()
+
+	if len(dirs) == 0 {
+		return
+	}
+
+	if err := runDirs(dirs); err != nil {
+		errorln(err)
+	}
+}
+
+// withTests filters out the directories that have no _test.go files
+func withTests(dirs []string) []string {
+	var keep []string
+	for _, dir := range dirs {
+		if matches, _ := filepath.Glob(filepath.Join(dir, "*_test.go")); len(matches) != 0 {
+			keep = append(keep, dir)
+		}
+	}
+
+	return keep
+}
+
+// runDirs tests the packages in all of dirs with one go test invocation
+// for each module from the directory they have in common.
+func runDirs(dirs []string) error {
+	// go test only takes packages from one module at a time
+	modules := make(map[string][]string)
+	for _, dir := range dirs {
+		root := findModuleRoot(dir)
+		modules[root] = append(modules[root], dir)
+	}
+
+	modRoots := make([]string, 0, len(modules))
+	for root := range modules {
+		modRoots = append(modRoots, root)
+	}
+	sort.Strings(modRoots)
+
+	for _, root := range modRoots {
+		if err := runModuleDirs(modules[root]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runModuleDirs is runDirs for dirs that are all in the same module.
+func runModuleDirs(dirs []string) error {
+	sort.Strings(dirs)
+	if len(dirs) == 1 {
+		queueRun(dirs[0])
+		return nil
+	}
+
+	// Separate runs can overlap, one go test would do the packages in turn.
+	// go test can only fuzz one package at a time.
+	if *flagJobs > 1 || *flagFuzz != "" {
+		for _, dir := range dirs {
+			queueRun(dir)
+		}
+		return nil
+	}
+
+	debugln("running tests for packages:", dirs)
+
+	common := dirs[0]
+	for _, dir := range dirs[1:] {
+		for common != dir && !strings.HasPrefix(dir, strings.TrimSuffix(common, string(filepath.Separator))+string(filepath.Separator)) {
+			common = filepath.Dir(common)
+		}
+	}
+
+	pkgs := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(common, dir)
+		if err != nil {
+			return errors.Wrapf(err, "failed to make %s relative", dir)
+		}
+
+		if rel == "." {
+			pkgs = append(pkgs, ".")
+		} else {
+			pkgs = append(pkgs, "./"+filepath.ToSlash(rel))
+		}
+	}
+
+	queueRun(common, pkgs...)
+	return nil
+}
+
+// queue holds the test runs waiting for the worker
+var queue = runQueue{
+	queued: make(map[string]struct{}),
+	wake:   make(chan struct{}, 1),
+}
+
+// runQueue is the list of test runs waiting to happen. Each target can only
+// be in the queue once, asking for it again while it's waiting does nothing
+// since the run hasn't started yet and will see the latest changes. With
+// -rtest-no-throttle every push is a run of its own, see seeThrough.
+type runQueue struct {
+	mu      sync.Mutex
+	pending []target
+	queued  map[string]struct{}
+	stopped bool
+
+	wake chan struct{}
+}
+
+// target is a directory to run go test in and the packages to test, argv
+// is only set when replaying an earlier command line exactly. mod is set
+// when go.mod changed.
+type target struct {
+	dir  string
+	pkgs []string
+	mod  bool
+	argv []string
+}
+
+func (t target) key() string {
+	key := t.dir + ":" + strings.Join(t.pkgs, " ")
+	if t.mod {
+		key += ":mod"
+	}
+	return key
+}
+
+// replayLast queues the last run again with the same command line
+func replayLast() bool {
+	lastMu.Lock()
+	t := lastRun
+	lastMu.Unlock()
+
+	if len(t.argv) == 0 {
+		return false
+	}
+
+	queue.push(t)
+	return true
+}
+
+// serveTarget is the target for the -rtest-run package, every change runs
+// it since it's restarted rather than tested.
+func serveTarget() target {
+	return target{dir: workingDir, pkgs: []string{*flagRun}}
+}
+
+// pinnedTarget is the -rtest-target package, it's tested instead of
+// whichever package changed.
+func pinnedTarget() target {
+	return target{dir: workingDir, pkgs: []string{*flagTarget}}
+}
+
+// queueRun queues a test run for the packages in dir, see runGoTest.
+func queueRun(dir string, pkgs ...string) {
+	queue.push(target{dir: dir, pkgs: pkgs})
+}
+
+func (q *runQueue) push(t target) {
+	key := t.key()
+
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return
+	}
+
+	// The results of the run in progress are stale now, fuzzing can take a
+	// long time so it's stopped for any new run. With -rtest-no-throttle
+	// every run is seen through.
+	if !seeThrough() {
+		if *flagFuzz != "" {
+			killRunning("")
+		} else {
+			killRunning(key)
+		}
+	}
+
+	if seeThrough() {
+		q.pending = append(q.pending, t)
+	} else if _, ok := q.queued[key]; !ok {
+		q.queued[key] = struct{}{}
+		q.pending = append(q.pending, t)
+	}
+	depth := len(q.pending)
+	q.mu.Unlock()
+
+	debugln("queued run:", key, "queue depth:", depth)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *runQueue) pop() (target, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stopped || len(q.pending) == 0 {
+		return target{}, false
+	}
+
+	t := q.pending[0]
+	q.pending = q.pending[1:]
+	key := t.key()
+	delete(q.queued, key)
+
+	debugln("starting run:", key, "queue depth:", len(q.pending))
+	return t, true
+}
+
+// stop empties the queue and stops any more runs from starting
+func (q *runQueue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.pending = nil
+	q.mu.Unlock()
+}
+
+// runWorker runs the queued test runs, at most -rtest-parallelism (or
+// -rtest-jobs) at a time and no closer together than -rtest-min-interval. It
+// never returns.
+func runWorker() {
+	slots := make(chan struct{}, maxRuns())
+	var lastStart time.Time
+
+	for range queue.wake {
+		for {
+			// A slot is taken and -rtest-min-interval waited out before
+			// popping so that targets wait in the queue, where asking for
+			// them again does nothing, rather than here
+			slots <- struct{}{}
+			if wait := *flagMinInterval - time.Since(lastStart); wait > 0 {
+				debugln("waiting before next run:", wait)
+				time.Sleep(wait)
+			}
+
+			t, ok := queue.pop()
+			if !ok {
+				<-slots
+				break
+			}
+			lastStart = time.Now()
+
+			go func(t target) {
+				defer func() { <-slots }()
+				runTarget(t)
+			}(t)
+		}
+	}
+}
+
+// runTarget runs the tests for t and waits for them to finish.
+func runTarget(t target) {
+	run, err := runGoTest(t)
+	if err != nil {
+		errorln(err)
+		return
+	}
+	if run == nil {
+		return
+	}
+
+	finishRun(run)
+	if run.rerun {
+		debugln("focused tests pass, running everything again")
+		queue.push(t)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stamp describes the go files a package is built from, when it's the same
+// as it was for the last passing run the package doesn't need testing.
+type stamp struct {
+	newest time.Time
+	files  int
+}
+
+var (
+	// passedStamps holds the stamp of each package directory from when its
+	// tests last passed
+	stampsMu     sync.Mutex
+	passedStamps = make(map[string]stamp)
+)
+
+// packageStamp stamps the go files in dir and in every package of the
+// module that it imports, a change to any of them could change the results.
+func packageStamp(dir string) stamp {
+	dirs, err := importedDirs(dir)
+	if err != nil {
+		debugln("failed to find imports, only stamping package:", err)
+		dirs = []string{dir}
+	}
+
+	var s stamp
+	for _, d := range dirs {
+		entries, err := ioutil.ReadDir(d)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".go" {
+				continue
+			}
+
+			s.files++
+			if entry.ModTime().After(s.newest) {
+				s.newest = entry.ModTime()
+			}
+		}
+	}
+
+	return s
+}
+
+// changedDirs filters out the directories whose packages haven't changed
+// since their tests last passed.
+func changedDirs(dirs []string) []string {
+	var keep []string
+	for _, dir := range dirs {
+		stampsMu.Lock()
+		passed, ok := passedStamps[dir]
+		stampsMu.Unlock()
+
+		if ok && passed == packageStamp(dir) {
+			debugln("unchanged since last passing run, skipping:", dir)
+			continue
+		}
+		keep = append(keep, dir)
+	}
+
+	return keep
+}
+
+// changedPackages filters out the packages of a run of pkgs in dir that
+// haven't changed since their tests last passed. Patterns like ./... are
+// expanded with go list so each package is checked on its own. No packages
+// means the package in dir so skip reports when nothing changed.
+func changedPackages(dir string, pkgs []string) (keep []string, skip bool, err error) {
+	if len(pkgs) == 0 {
+		return pkgs, len(changedDirs([]string{dir})) == 0, nil
+	}
+
+	pkgDirs, err := listPackages(dir, pkgs)
+	if err != nil {
+		return nil, false, err
+	}
+
+	keep, err = relativePackages(dir, changedDirs(pkgDirs))
+	return keep, len(keep) == 0, err
+}
+
+// runStamps stamps the packages a run of pkgs in dir tests. Patterns are
+// expanded by changedPackages first, import paths are left unstamped.
+func runStamps(dir string, pkgs []string) map[string]stamp {
+	dirs := []string{dir}
+	if len(pkgs) != 0 {
+		dirs = dirs[:0]
+		for _, pkg := range pkgs {
+			if strings.Contains(pkg, "...") || !strings.HasPrefix(pkg, ".") {
+				return nil
+			}
+			dirs = append(dirs, filepath.Join(dir, filepath.FromSlash(pkg)))
+		}
+	}
+
+	stamps := make(map[string]stamp, len(dirs))
+	for _, d := range dirs {
+		stamps[d] = packageStamp(d)
+	}
+	return stamps
+}
+
+// recordStamps remembers the stamps of a passing run.
+func recordStamps(stamps map[string]stamp) {
+	stampsMu.Lock()
+	defer stampsMu.Unlock()
+
+	for dir, s := range stamps {
+		passedStamps[dir] = s
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// stateFile holds settings changed while rtest was running, like the
+// /pattern test filter, so the next run starts with them. It's kept next to
+// the config file and uses the same format.
+const stateFile = ".rtest.state"
+
+var (
+	stateMu     sync.Mutex
+	statePath   string
+	stateValues = make(map[string]string)
+)
+
+// loadState applies the settings saved in dir by an earlier run that weren't
+// given on the command line.
+func loadState(dir string) error {
+	statePath = filepath.Join(dir, stateFile)
+	if _, err := os.Stat(statePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	state, err := loadConfig(statePath)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range state.flags {
+		stateValues[key] = value
+	}
+	return state.applyFlags()
+}
+
+// saveState remembers a setting, key is a flag name without the rtest-
+// prefix. Failing to save is only a warning.
+func saveState(key, value string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	stateValues[key] = value
+
+	keys := make([]string, 0, len(stateValues))
+	for k := range stateValues {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString("# settings changed while rtest was running, they override .rtest.toml\n")
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s = %s\n", k, strconv.Quote(stateValues[k]))
+	}
+
+	if err := ioutil.WriteFile(statePath, buf.Bytes(), 0644); err != nil {
+		warnln("failed to save settings:", err)
+	}
+}
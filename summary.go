@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runSummary is how the test runs have gone so far, it's printed and
+// decides the exit code when rtest shuts down.
+type runSummary struct {
+	runs     int
+	failures int
+	// the rest are from the most recent run
+	dir      string
+	pkgs     []string
+	passed   bool
+	code     int
+	start    time.Time
+	finished time.Time
+}
+
+var (
+	summaryMu sync.Mutex
+	summary   runSummary
+	// targetPassed is whether the last run of each target passed
+	targetPassed = make(map[string]bool)
+
+	// runLog is the -rtest-log file, nil without one
+	runLog io.Writer
+)
+
+// recordRun adds a finished run to the summary, runs that were killed
+// because something newer superseded them aren't recorded.
+func recordRun(t *testRun, passed bool, exitCode int) {
+	summaryMu.Lock()
+	defer summaryMu.Unlock()
+
+	summary.runs++
+	if !passed {
+		summary.failures++
+	}
+	summary.dir = t.dir
+	summary.pkgs = t.pkgs
+	summary.passed = passed
+	summary.code = exitCode
+	summary.start = t.start
+	summary.finished = time.Now()
+
+	if runLog != nil {
+		logRun(runLog, t, passed, summary.finished)
+	}
+}
+
+// logRun appends a tab separated line for the run to w: when it finished,
+// what was tested, how long it took, PASS or FAIL and how many tests
+// failed.
+func logRun(w io.Writer, t *testRun, passed bool, finished time.Time) {
+	target := relativeDir(t.dir)
+	if len(t.pkgs) != 0 {
+		target += " (" + strings.Join(t.pkgs, " ") + ")"
+	}
+
+	status := "FAIL"
+	if passed {
+		status = "PASS"
+	}
+
+	failed := 0
+	if t.results != nil {
+		failed = len(t.results.failed)
+	}
+
+	elapsed := finished.Sub(t.start).Round(time.Millisecond)
+	if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d failed\n", finished.Format(time.RFC3339), target, elapsed, status, failed); err != nil {
+		debugln("failed to write run log:", err)
+	}
+}
+
+// statusChanged records whether the run of a target passed and checks if
+// that's different from its last run. A target's first run only counts as a
+// change when it fails, everything is assumed to pass to begin with.
+func statusChanged(key string, passed bool) bool {
+	summaryMu.Lock()
+	defer summaryMu.Unlock()
+
+	last, ok := targetPassed[key]
+	targetPassed[key] = passed
+	if !ok {
+		return !passed
+	}
+	return last != passed
+}
+
+// lastSummary returns a copy of the summary.
+func lastSummary() runSummary {
+	summaryMu.Lock()
+	defer summaryMu.Unlock()
+
+	return summary
+}
+
+// printSummary prints how many runs there were and how many failed.
+func printSummary(s runSummary) {
+	if s.runs == 0 {
+		return
+	}
+
+	status := "passed"
+	if !s.passed {
+		status = "failed"
+	}
+	fmt.Fprintf(os.Stderr, "%d runs, %d failed, last run %s\n", s.runs, s.failures, status)
+}
+
+// exitCode is the code rtest exits with, the most recent run's exit code so
+// scripts can tell whether the code was left passing. With no runs it's 0.
+func (s runSummary) exitCode() int {
+	if s.runs == 0 || s.passed {
+		return 0
+	}
+	return s.code
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	colorReset = "\033[0m"
+	colorDim   = "\033[2m"
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+)
+
+// useColor decides if output written to f should be colored, -rtest-color
+// can force it on or off, otherwise it's only colored when f is a terminal.
+func useColor(f *os.File) bool {
+	switch *flagColor {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return isTerminal(f)
+	}
+}
+
+// colorize wraps s in the color code when output to f should be colored
+func colorize(f *os.File, color, s string) string {
+	if !useColor(f) {
+		return s
+	}
+
+	return color + s + colorReset
+}
+
+// isTerminal checks if f is a terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// printHeader prints the line that marks the start of a test run so it's easy
+// to find where the output for the latest run begins.
+func printHeader(dir string, pkgs []string, uncached bool) {
+	target := relativeDir(dir)
+	if len(pkgs) != 0 {
+		target += " (" + strings.Join(pkgs, " ") + ")"
+	}
+
+	action := "running tests in"
+	if *flagRun != "" {
+		action = "starting"
+	} else if *flagBuild {
+		action = "building"
+	} else if uncached {
+		target += ", uncached"
+	} else {
+		target += ", cached"
+	}
+
+	line := fmt.Sprintf("── %s %s %s ──", time.Now().Format("15:04:05"), action, target)
+	fmt.Fprintln(os.Stderr, colorize(os.Stderr, colorDim, line))
+}
+
+// printDigest names the tests that failed so they don't have to be found in
+// the output, with the number of tests that ran when it's known.
+func printDigest(failed []string, total int) {
+	if len(failed) == 0 {
+		return
+	}
+
+	line := "FAILED: " + strings.Join(failed, ", ")
+	if total != 0 {
+		line += fmt.Sprintf(" (%d of %d)", len(failed), total)
+	}
+	fmt.Fprintln(os.Stderr, colorize(os.Stderr, colorRed, line))
+}
+
+// printFooter prints a one line summary of a finished test run.
+func printFooter(dir string, passed bool, elapsed time.Duration, attempts int) {
+	status, color := "FAIL", colorRed
+	if passed {
+		status, color = "PASS", colorGreen
+	}
+
+	took := elapsed.Round(time.Millisecond).String()
+	if attempts > 1 {
+		took += fmt.Sprintf(", %d attempts", attempts)
+	}
+	line := fmt.Sprintf("%s %s (%s)", status, relativeDir(dir), took)
+	fmt.Fprintln(os.Stderr, colorize(os.Stderr, color, line))
+}
+
+// printCommand prints the command being run in dir so that it can be copied
+// into a shell to run it by hand, for -rtest-echo-cmd.
+func printCommand(dir, name string, args []string) {
+	words := []string{shellQuote(name)}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+
+	line := strings.Join(words, " ")
+	if rel := relativeDir(dir); rel != "." {
+		line = fmt.Sprintf("(cd %s && %s)", shellQuote(rel), line)
+	}
+	fmt.Fprintln(os.Stderr, colorize(os.Stderr, colorDim, line))
+}
+
+// shellQuote quotes s for a posix shell when it has anything in it the
+// shell would treat specially.
+func shellQuote(s string) string {
+	if len(s) != 0 && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+.,/:@%") == "" {
+		return s
+	}
+
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// relativeDir makes dir relative to the working directory for display
+func relativeDir(dir string) string {
+	rel, err := filepath.Rel(workingDir, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return dir
+	}
+	if rel == "." {
+		return "."
+	}
+
+	return "./" + filepath.ToSlash(rel)
+}
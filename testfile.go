@@ -0,0 +1,53 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strings"
+)
+
+// testFile is set when rtest was given a single _test.go file instead of
+// directories. Only its directory is watched and only its tests are run.
+var testFile string
+
+// isTestFileArg checks if a positional argument names a test file rather
+// than a directory to watch.
+func isTestFileArg(path string) bool {
+	return strings.HasSuffix(path, "_test.go")
+}
+
+// fileTestsPattern builds a -run pattern matching the tests, examples and
+// fuzz targets declared in file. The file is parsed for every run so that
+// tests added while working are picked up. An empty string means the file
+// couldn't be parsed, in which case the whole package runs and the
+// compiler reports the problem.
+func fileTestsPattern(file string) string {
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	if err != nil {
+		debugln("failed to parse test file:", err)
+		return ""
+	}
+
+	var names []string
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil {
+			continue
+		}
+
+		name := fn.Name.Name
+		for _, prefix := range []string{"Test", "Example", "Fuzz"} {
+			if strings.HasPrefix(name, prefix) && name != "TestMain" {
+				names = append(names, regexp.QuoteMeta(name))
+				break
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		return "^$"
+	}
+	return "^(" + strings.Join(names, "|") + ")$"
+}